@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/subtle"
+	"github.com/giorgiovilardo/etnograbber/clock"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type ApiKey struct {
+	Name      string    `mapstructure:"name" validate:"required"`
+	Key       string    `mapstructure:"key" validate:"required"`
+	Routes    []string  `mapstructure:"routes"`
+	ExpiresAt time.Time `mapstructure:"expires_at"`
+}
+
+// allows reports whether the key may call the route, keys without routes
+// may call all of them.
+func (k ApiKey) allows(route string) bool {
+	if len(k.Routes) == 0 {
+		return true
+	}
+	for _, r := range k.Routes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+func (k ApiKey) isExpired(c clock.Clock) bool {
+	return !k.ExpiresAt.IsZero() && k.ExpiresAt.Before(c.Now())
+}
+
+// ApiKeys holds the configured keys and can be swapped at runtime, so a key
+// can be rotated without a restart. Turning api keys on or off changes the
+// routes and takes a restart.
+type ApiKeys struct {
+	keys atomic.Pointer[[]ApiKey]
+}
+
+func NewApiKeys(keys []ApiKey) *ApiKeys {
+	k := &ApiKeys{}
+	k.keys.Store(&keys)
+	return k
+}
+
+func (k *ApiKeys) Reload(c Config) {
+	if (len(c.ApiKeys) == 0) != (len(k.list()) == 0) {
+		log.Printf("api keys can only be turned on or off with a restart, keeping the running api keys")
+		return
+	}
+	keys := c.ApiKeys
+	k.keys.Store(&keys)
+}
+
+func (k *ApiKeys) list() []ApiKey {
+	return *k.keys.Load()
+}
+
+const apiKeyNameContextKey = "api_key_name"
+
+// ApiKeyAuth requires one of the configured keys, from the X-Api-Key header
+// or the api_key query param for clients like <audio src>, on every route
+// but the health ones and the requests the skipper lets through.
+// The name of the key is stored in the context.
+func ApiKeyAuth(keys *ApiKeys, clock clock.Clock, skipper middleware.Skipper) echo.MiddlewareFunc {
+	if skipper == nil {
+		skipper = middleware.DefaultSkipper
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if isHealthRoute(c.Path()) || skipper(c) {
+				return next(c)
+			}
+
+			provided := requestApiKey(c)
+			if provided == "" {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": apiKeyMissing})
+			}
+
+			key, found := findApiKey(keys.list(), provided)
+			if !found {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": apiKeyInvalid})
+			}
+			c.Set(apiKeyNameContextKey, key.Name)
+			if key.isExpired(clock) {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": apiKeyExpired})
+			}
+			if !key.allows(c.Path()) {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": apiKeyForbidden})
+			}
+
+			return next(c)
+		}
+	}
+}
+
+func findApiKey(keys []ApiKey, provided string) (ApiKey, bool) {
+	var found ApiKey
+	ok := false
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(provided)) == 1 {
+			found, ok = k, true
+		}
+	}
+	return found, ok
+}
+
+func isHealthRoute(path string) bool {
+	return path == "/health" || strings.HasPrefix(path, "/health/")
+}
+
+// RequestLogger logs every request along with the name of the api key that
+// made it, if any.
+func RequestLogger() echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		LogMethod:   true,
+		LogURIPath:  true,
+		LogStatus:   true,
+		LogLatency:  true,
+		LogRemoteIP: true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			keyName, _ := c.Get(apiKeyNameContextKey).(string)
+			if keyName == "" {
+				keyName = "-"
+			}
+			log.Printf("%s %s %s %d %s key=%s", v.RemoteIP, v.Method, v.URIPath, v.Status, v.Latency, keyName)
+			return nil
+		},
+	})
+}
+
+const (
+	apiKeyMissing   = "missing api key"
+	apiKeyInvalid   = "invalid api key"
+	apiKeyExpired   = "api key expired"
+	apiKeyForbidden = "api key not allowed on this route"
+)
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApiKeyAuth(t *testing.T) {
+	clock := newMockClock()
+	keys := []ApiKey{
+		{Name: "php", Key: "php-key"},
+		{Name: "player", Key: "player-key", Routes: []string{"/:trackId/stream"}},
+		{Name: "old", Key: "old-key", ExpiresAt: clock.Now().Add(-time.Hour)},
+	}
+	setupEcho := func() *echo.Echo {
+		e := echo.New()
+		e.Use(ApiKeyAuth(NewApiKeys(keys), clock, nil))
+		ok := func(c echo.Context) error {
+			name, _ := c.Get(apiKeyNameContextKey).(string)
+			return c.String(http.StatusOK, name)
+		}
+		e.GET("/health", ok)
+		e.GET("/:trackId", ok)
+		e.GET("/:trackId/stream", ok)
+		return e
+	}
+	request := func(e *echo.Echo, target string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("should accept a key from the header and expose its name", func(t *testing.T) {
+		rec := request(setupEcho(), "/1234", map[string]string{apiKeyHeader: "php-key"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "php", rec.Body.String())
+	})
+
+	t.Run("should accept a key from the query string", func(t *testing.T) {
+		rec := request(setupEcho(), "/1234/stream?api_key=player-key", nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "player", rec.Body.String())
+	})
+
+	t.Run("should not require a key on health routes", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, request(setupEcho(), "/health", nil).Code)
+	})
+
+	t.Run("should let through what the skipper skips", func(t *testing.T) {
+		e := echo.New()
+		e.Use(ApiKeyAuth(NewApiKeys(keys), clock, func(c echo.Context) bool {
+			return c.QueryParam("skip") == "yes"
+		}))
+		e.GET("/:trackId", func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		})
+		assert.Equal(t, http.StatusOK, request(e, "/1234?skip=yes", nil).Code)
+		assert.Equal(t, http.StatusUnauthorized, request(e, "/1234", nil).Code)
+	})
+
+	t.Run("should reject requests without a key", func(t *testing.T) {
+		rec := request(setupEcho(), "/1234", nil)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Equal(t, `{"error":"missing api key"}`, strings.Trim(rec.Body.String(), "\n"))
+	})
+
+	t.Run("should reject unknown keys", func(t *testing.T) {
+		rec := request(setupEcho(), "/1234", map[string]string{apiKeyHeader: "nope"})
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Equal(t, `{"error":"invalid api key"}`, strings.Trim(rec.Body.String(), "\n"))
+	})
+
+	t.Run("should reject expired keys", func(t *testing.T) {
+		rec := request(setupEcho(), "/1234", map[string]string{apiKeyHeader: "old-key"})
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Equal(t, `{"error":"api key expired"}`, strings.Trim(rec.Body.String(), "\n"))
+	})
+
+	t.Run("should accept rotated keys after a reload", func(t *testing.T) {
+		apiKeys := NewApiKeys(keys)
+		e := echo.New()
+		e.Use(ApiKeyAuth(apiKeys, clock, nil))
+		e.GET("/:trackId", func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		})
+		apiKeys.Reload(Config{ApiKeys: []ApiKey{{Name: "php", Key: "new-key"}}})
+		assert.Equal(t, http.StatusOK, request(e, "/1234", map[string]string{apiKeyHeader: "new-key"}).Code)
+		assert.Equal(t, http.StatusUnauthorized, request(e, "/1234", map[string]string{apiKeyHeader: "php-key"}).Code)
+	})
+
+	t.Run("should keep the keys when a reload would turn them off", func(t *testing.T) {
+		apiKeys := NewApiKeys(keys)
+		apiKeys.Reload(Config{})
+		assert.Equal(t, keys, apiKeys.list())
+	})
+
+	t.Run("should reject keys on routes they are not allowed on", func(t *testing.T) {
+		rec := request(setupEcho(), "/1234", map[string]string{apiKeyHeader: "player-key"})
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Equal(t, `{"error":"api key not allowed on this route"}`, strings.Trim(rec.Body.String(), "\n"))
+	})
+}
+
+func TestRequestLogger(t *testing.T) {
+	t.Run("should log the name of the api key", func(t *testing.T) {
+		var out bytes.Buffer
+		log.SetOutput(&out)
+		defer log.SetOutput(os.Stderr)
+		e := echo.New()
+		e.Use(RequestLogger())
+		e.Use(ApiKeyAuth(NewApiKeys([]ApiKey{{Name: "php", Key: "php-key"}}), newMockClock(), nil))
+		e.GET("/:trackId", func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		})
+		req := httptest.NewRequest(http.MethodGet, "/1234", nil)
+		req.Header.Set(apiKeyHeader, "php-key")
+		e.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Contains(t, out.String(), "GET /1234 200")
+		assert.Contains(t, out.String(), "key=php")
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"github.com/giorgiovilardo/etnograbber/clock"
+	"sync"
+	"time"
+)
+
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `mapstructure:"failure_threshold" validate:"gte=0"`
+	OpenTimeout      time.Duration `mapstructure:"open_timeout" validate:"gte=0"`
+	HalfOpenProbes   int           `mapstructure:"half_open_probes" validate:"gte=0"`
+}
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type CircuitOpenError struct {
+	wait time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return "circuit open, upstream unavailable"
+}
+
+func (e *CircuitOpenError) RetryAfter() time.Duration {
+	return e.wait
+}
+
+// CircuitBreaker opens after FailureThreshold consecutive failures and fails
+// fast for OpenTimeout, then lets HalfOpenProbes calls through: if they all
+// succeed it closes again, a single failure reopens it.
+// A zero FailureThreshold disables it.
+type CircuitBreaker struct {
+	c        CircuitBreakerConfig
+	clock    clock.Clock
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probes   int
+	passed   int
+}
+
+func NewCircuitBreaker(c CircuitBreakerConfig, clock clock.Clock) *CircuitBreaker {
+	b := &CircuitBreaker{clock: clock}
+	b.Reload(c)
+	return b
+}
+
+// Reload applies new thresholds, disabling the breaker also closes it.
+func (b *CircuitBreaker) Reload(c CircuitBreakerConfig) {
+	if c.HalfOpenProbes < 1 {
+		c.HalfOpenProbes = 1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.c = c
+	if c.FailureThreshold == 0 {
+		b.state = CircuitClosed
+		b.failures = 0
+	}
+}
+
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.c.FailureThreshold == 0 {
+		return nil
+	}
+	switch b.state {
+	case CircuitOpen:
+		elapsed := b.clock.Now().Sub(b.openedAt)
+		if elapsed < b.c.OpenTimeout {
+			return &CircuitOpenError{wait: b.c.OpenTimeout - elapsed}
+		}
+		b.state = CircuitHalfOpen
+		b.probes = 0
+		b.passed = 0
+		fallthrough
+	case CircuitHalfOpen:
+		if b.probes >= b.c.HalfOpenProbes {
+			return &CircuitOpenError{wait: b.c.OpenTimeout}
+		}
+		b.probes++
+	}
+	return nil
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.c.FailureThreshold == 0 {
+		return
+	}
+	b.failures = 0
+	if b.state == CircuitHalfOpen {
+		b.passed++
+		if b.passed >= b.c.HalfOpenProbes {
+			b.state = CircuitClosed
+		}
+	}
+}
+
+// Release gives back a call let through by Allow that tells nothing about
+// upstream health, like one that was never sent or got rate limited, so a
+// half-open circuit waits for a real probe.
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.c.FailureThreshold == 0 {
+		return
+	}
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.c.FailureThreshold {
+		b.state = CircuitOpen
+		b.openedAt = b.clock.Now()
+	}
+}
+
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
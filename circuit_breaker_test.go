@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	config := CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: time.Second * 30, HalfOpenProbes: 1}
+
+	t.Run("should open after the failure threshold and fail fast", func(t *testing.T) {
+		b := NewCircuitBreaker(config, newMockClock())
+		b.Failure()
+		assert.Equal(t, CircuitClosed, b.State())
+		assert.NoError(t, b.Allow())
+		b.Failure()
+		assert.Equal(t, CircuitOpen, b.State())
+		var open *CircuitOpenError
+		assert.True(t, errors.As(b.Allow(), &open))
+		assert.Equal(t, time.Second*30, open.RetryAfter())
+	})
+
+	t.Run("should only count consecutive failures", func(t *testing.T) {
+		b := NewCircuitBreaker(config, newMockClock())
+		b.Failure()
+		b.Success()
+		b.Failure()
+		assert.Equal(t, CircuitClosed, b.State())
+	})
+
+	t.Run("should let a probe through after the open timeout and close on success", func(t *testing.T) {
+		clock := newMockClock()
+		b := NewCircuitBreaker(config, clock)
+		b.Failure()
+		b.Failure()
+		clock.Sleep(time.Second * 10)
+		var open *CircuitOpenError
+		assert.True(t, errors.As(b.Allow(), &open))
+		assert.Equal(t, time.Second*20, open.RetryAfter())
+		clock.Sleep(time.Second * 20)
+		assert.NoError(t, b.Allow())
+		assert.Equal(t, CircuitHalfOpen, b.State())
+		assert.Error(t, b.Allow())
+		b.Success()
+		assert.Equal(t, CircuitClosed, b.State())
+		assert.NoError(t, b.Allow())
+	})
+
+	t.Run("should wait for another probe after a released one", func(t *testing.T) {
+		clock := newMockClock()
+		b := NewCircuitBreaker(config, clock)
+		b.Failure()
+		b.Failure()
+		clock.Sleep(time.Second * 30)
+		assert.NoError(t, b.Allow())
+		b.Release()
+		assert.Equal(t, CircuitHalfOpen, b.State())
+		assert.NoError(t, b.Allow())
+		b.Success()
+		assert.Equal(t, CircuitClosed, b.State())
+	})
+
+	t.Run("should reopen if the probe fails", func(t *testing.T) {
+		clock := newMockClock()
+		b := NewCircuitBreaker(config, clock)
+		b.Failure()
+		b.Failure()
+		clock.Sleep(time.Second * 30)
+		assert.NoError(t, b.Allow())
+		b.Failure()
+		assert.Equal(t, CircuitOpen, b.State())
+		assert.Error(t, b.Allow())
+	})
+
+	t.Run("should never open when disabled", func(t *testing.T) {
+		b := NewCircuitBreaker(CircuitBreakerConfig{}, newMockClock())
+		for i := 0; i < 10; i++ {
+			b.Failure()
+		}
+		assert.Equal(t, CircuitClosed, b.State())
+		assert.NoError(t, b.Allow())
+	})
+
+	t.Run("should close when disabled by a reload", func(t *testing.T) {
+		b := NewCircuitBreaker(config, newMockClock())
+		b.Failure()
+		b.Failure()
+		b.Reload(CircuitBreakerConfig{})
+		assert.Equal(t, CircuitClosed, b.State())
+		assert.NoError(t, b.Allow())
+	})
+}
@@ -4,28 +4,36 @@ import "time"
 
 type Clock interface {
 	Now() time.Time
+	Sleep(d time.Duration)
 }
 
 type FunctionalClock struct {
-	now func() time.Time
+	now   func() time.Time
+	sleep func(d time.Duration)
 }
 
 func (f FunctionalClock) Now() time.Time {
 	return f.now()
 }
 
+func (f FunctionalClock) Sleep(d time.Duration) {
+	f.sleep(d)
+}
+
 // NewRealClock produces an instance of FunctionalClock, implementing Clock,
-// with time.Now() preloaded as a time producing fn.
+// with time.Now() preloaded as a time producing fn and time.Sleep() as the
+// waiting fn.
 func NewRealClock() Clock {
 	return FunctionalClock{now: func() time.Time {
 		return time.Now()
-	}}
+	}, sleep: time.Sleep}
 }
 
 // NewBrokenClock produces an instance of FunctionalClock, implementing Clock,
 // with the passed time.Time as the returning value of Clock.Now()
+// and a Clock.Sleep() that returns immediately, as time never passes.
 func NewBrokenClock(t time.Time) Clock {
 	return FunctionalClock{now: func() time.Time {
 		return t
-	}}
+	}, sleep: func(_ time.Duration) {}}
 }
@@ -40,3 +40,18 @@ func TestNewRealClock(t *testing.T) {
 		assert.IsType(t, time.Time{}, clock.Now())
 	})
 }
+
+func TestFunctionalClock_Sleep(t *testing.T) {
+	t.Run("should not wait on a broken clock", func(t *testing.T) {
+		started := time.Now()
+		clockLib.NewBrokenClock(time.Date(2021, 8, 25, 8, 30, 0, 0, time.UTC)).Sleep(time.Hour)
+		assert.Less(t, time.Since(started), time.Second)
+	})
+
+	t.Run("should wait on a real clock", func(t *testing.T) {
+		clock := clockLib.NewRealClock()
+		started := clock.Now()
+		clock.Sleep(time.Millisecond * 10)
+		assert.GreaterOrEqual(t, clock.Now().Sub(started), time.Millisecond*10)
+	})
+}
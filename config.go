@@ -1,36 +1,180 @@
 package main
 
 import (
+	"errors"
 	"github.com/go-playground/validator/v10"
 	"github.com/spf13/viper"
+	"io/fs"
 	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
 )
 
-const configFileName = "config.toml"
+const (
+	configFileName = "config.toml"
+	envPrefix      = "etnograbber"
+)
 
 type Config struct {
-	BaseApiUrl      string   `mapstructure:"base_api_url" validate:"required,url"`
-	BaseAuthUrl     string   `mapstructure:"base_auth_url" validate:"required,url"`
-	ClientId        string   `mapstructure:"client_id" validate:"required"`
-	ClientSecret    string   `mapstructure:"client_secret" validate:"required"`
-	FallbackAuthUrl string   `mapstructure:"token_generator_fallback" validate:"required,url"`
-	AllowedOrigins  []string `mapstructure:"allowed_origins" validate:"required"`
-	CacheSize       int      `mapstructure:"cache_size" validate:"required,gte=1,lte=30"`
-	Address         string   `mapstructure:"address" validate:"required"`
+	BaseApiUrl         string                  `mapstructure:"base_api_url" validate:"required,url"`
+	BaseAuthUrl        string                  `mapstructure:"base_auth_url" validate:"required,url"`
+	ClientId           string                  `mapstructure:"client_id" validate:"required_without=ClientCredentials"`
+	ClientSecret       string                  `mapstructure:"client_secret" validate:"required_without=ClientCredentials"`
+	ClientCredentials  []Credential            `mapstructure:"credentials" validate:"dive"`
+	CredentialCooldown time.Duration           `mapstructure:"credential_cooldown" validate:"gte=0"`
+	FallbackAuthUrl    string                  `mapstructure:"token_generator_fallback" validate:"required,url"`
+	AllowedOrigins     []string                `mapstructure:"allowed_origins" validate:"required"`
+	CacheSize          int                     `mapstructure:"cache_size" validate:"required,gte=1,lte=30"`
+	Address            string                  `mapstructure:"address" validate:"required"`
+	ShutdownTimeout    time.Duration           `mapstructure:"shutdown_timeout" validate:"gte=0"`
+	MaxRedirects       int                     `mapstructure:"max_redirects" validate:"gte=0"`
+	RedirectStreams    bool                    `mapstructure:"redirect_streams"`
+	StreamFormats      []string                `mapstructure:"stream_formats" validate:"dive,oneof=http_mp3_128 hls_mp3_128 hls_aac_160 hls_opus_64"`
+	HlsCacheSize       int                     `mapstructure:"hls_cache_size" validate:"required,gte=1"`
+	MetadataCacheSize  int                     `mapstructure:"metadata_cache_size" validate:"required,gte=1"`
+	MetadataCacheTtl   time.Duration           `mapstructure:"metadata_cache_ttl" validate:"gt=0"`
+	Retry              RetryConfig             `mapstructure:"retry"`
+	CircuitBreaker     CircuitBreakerConfig    `mapstructure:"circuit_breaker"`
+	UpstreamRateLimit  UpstreamRateLimitConfig `mapstructure:"upstream_rate_limit"`
+	UpstreamHttp       UpstreamHttpConfig      `mapstructure:"upstream_http"`
+	InboundRateLimit   InboundRateLimitConfig  `mapstructure:"inbound_rate_limit"`
+	ApiKeys            []ApiKey                `mapstructure:"api_keys" validate:"dive"`
+	StreamSigning      StreamSigningConfig     `mapstructure:"stream_signing"`
+	Tls                TlsConfig               `mapstructure:"tls"`
+	TokenFallback      TokenFallbackConfig     `mapstructure:"token_fallback"`
+	TokenExport        TokenExportConfig       `mapstructure:"token_export"`
+	TokenStore         TokenStoreConfig        `mapstructure:"token_store"`
+	RedisCache         RedisCacheConfig        `mapstructure:"redis_cache"`
+	ContentValidation  ContentValidationConfig `mapstructure:"content_validation"`
+	Transcoding        TranscodingConfig       `mapstructure:"transcoding"`
+	Waveform           WaveformConfig          `mapstructure:"waveform"`
+}
+
+// GetConfig reads the config file at path, or config.toml when path is empty,
+// and lets ETNOGRABBER_* environment variables override it. Without an explicit
+// path a missing config.toml is fine, the environment alone is enough.
+func GetConfig(path string) Config {
+	v := viper.GetViper()
+	setConfigDefaults(v)
+	bindConfigEnv(v)
+	if path == "" {
+		path = configFileName
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			path = ""
+		}
+	}
+	if path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			log.Fatalf("config file %s: %v", path, err)
+		}
+	}
+	c, err := loadConfig(v)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	return c
+}
+
+// Credentials lists the configured credentials, client_id and client_secret
+// being the only one unless a credentials list is given.
+func (c Config) Credentials() []Credential {
+	if len(c.ClientCredentials) > 0 {
+		return c.ClientCredentials
+	}
+	return []Credential{{Name: "default", ClientId: c.ClientId, ClientSecret: c.ClientSecret}}
 }
 
-func GetConfig() (c Config) {
-	viper.SetConfigFile(configFileName)
-	viper.AddConfigPath(".")
-	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalf("config file %s not found", configFileName)
+// loadConfig unmarshals, resolves the secrets of and validates what v
+// currently holds.
+func loadConfig(v *viper.Viper) (Config, error) {
+	var c Config
+	if err := v.Unmarshal(&c); err != nil {
+		return Config{}, err
 	}
-	if err := viper.Unmarshal(&c); err != nil {
-		log.Fatalf("config file %s not found", configFileName)
+	if err := resolveSecrets(&c); err != nil {
+		return Config{}, err
 	}
 	validate := validator.New()
 	if err := validate.Struct(&c); err != nil {
-		log.Fatalf(err.Error())
+		return Config{}, err
+	}
+	return c, nil
+}
+
+func setConfigDefaults(v *viper.Viper) {
+	v.SetDefault("shutdown_timeout", "30s")
+	v.SetDefault("credential_cooldown", "10m")
+	v.SetDefault("hls_cache_size", 500)
+	v.SetDefault("metadata_cache_size", 1000)
+	v.SetDefault("metadata_cache_ttl", "10m")
+	v.SetDefault("retry.max_attempts", 3)
+	v.SetDefault("retry.base_delay", "200ms")
+	v.SetDefault("retry.max_delay", "5s")
+	v.SetDefault("retry.jitter", 0.5)
+	v.SetDefault("circuit_breaker.failure_threshold", 5)
+	v.SetDefault("circuit_breaker.open_timeout", "30s")
+	v.SetDefault("circuit_breaker.half_open_probes", 1)
+	v.SetDefault("upstream_rate_limit.max_wait", "2s")
+	v.SetDefault("upstream_rate_limit.default_pause", "60s")
+	v.SetDefault("upstream_http.auth_timeout", "5s")
+	v.SetDefault("upstream_http.metadata_timeout", "5s")
+	v.SetDefault("upstream_http.stream_connect_timeout", "10s")
+	v.SetDefault("upstream_http.stream_idle_timeout", "20s")
+	v.SetDefault("upstream_http.max_idle_conns", 100)
+	v.SetDefault("upstream_http.max_idle_conns_per_host", 10)
+	v.SetDefault("upstream_http.idle_conn_timeout", "90s")
+	v.SetDefault("upstream_http.tls_handshake_timeout", "10s")
+	v.SetDefault("stream_signing.default_ttl", "1h")
+	v.SetDefault("stream_signing.max_ttl", "24h")
+	v.SetDefault("tls.autocert_cache_dir", "certs")
+	v.SetDefault("token_fallback.min_ttl", "1m")
+	v.SetDefault("token_store.redis_prefix", "etnograbber:token:")
+	v.SetDefault("token_store.lease_ttl", "30s")
+	v.SetDefault("token_store.refresh_interval", "10s")
+	v.SetDefault("token_store.renew_before", "5m")
+	v.SetDefault("redis_cache.prefix", "etnograbber:cache:")
+	v.SetDefault("redis_cache.track_ttl", "24h")
+	v.SetDefault("redis_cache.chunk_size", 512*1024)
+	v.SetDefault("redis_cache.retry_after", "10s")
+	v.SetDefault("content_validation.min_size", 1024)
+	v.SetDefault("transcoding.max_concurrent", 2)
+	v.SetDefault("transcoding.timeout", "2m")
+	v.SetDefault("transcoding.min_bitrate", 32)
+	v.SetDefault("transcoding.max_bitrate", 320)
+	v.SetDefault("transcoding.default_bitrate", 64)
+	v.SetDefault("waveform.source", waveformSourceSoundcloud)
+	v.SetDefault("waveform.samples", 200)
+	v.SetDefault("waveform.max_samples", 1800)
+	v.SetDefault("waveform.cache_size", 500)
+}
+
+// bindConfigEnv maps every Config key to an environment variable, so
+// retry.max_attempts is read from ETNOGRABBER_RETRY_MAX_ATTEMPTS. Lists are
+// comma separated. api_keys can only be set in the config file.
+func bindConfigEnv(v *viper.Viper) {
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	for _, key := range configKeys(reflect.TypeOf(Config{}), "") {
+		_ = v.BindEnv(key)
+	}
+}
+
+func configKeys(t reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := prefix + f.Tag.Get("mapstructure")
+		switch {
+		case f.Type.Kind() == reflect.Struct && f.Type != reflect.TypeOf(time.Time{}):
+			keys = append(keys, configKeys(f.Type, key+".")...)
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct:
+			// tables of tables have no sensible env representation
+		default:
+			keys = append(keys, key)
+		}
 	}
-	return
+	return keys
 }
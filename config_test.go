@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const validTestConfig = `
+base_api_url = 'https://api.soundcloud.com/tracks'
+base_auth_url = 'https://api.soundcloud.com/oauth2/token'
+client_id = 'id'
+client_secret = 'secret'
+token_generator_fallback = 'https://fallback.example.com'
+allowed_origins = ['*']
+cache_size = 30
+address = ':5000'
+`
+
+func newTestViper(t *testing.T, toml string) *viper.Viper {
+	v := viper.New()
+	setConfigDefaults(v)
+	v.SetConfigType("toml")
+	if err := v.ReadConfig(strings.NewReader(toml)); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("should load a valid config, applying defaults", func(t *testing.T) {
+		c, err := loadConfig(newTestViper(t, validTestConfig))
+		assert.NoError(t, err)
+		assert.Equal(t, "id", c.ClientId)
+		assert.Equal(t, 500, c.HlsCacheSize)
+		assert.Equal(t, time.Millisecond*200, c.Retry.BaseDelay)
+	})
+
+	t.Run("should accept a credentials list instead of client_id and client_secret", func(t *testing.T) {
+		toml := strings.Replace(strings.Replace(validTestConfig, "client_id = 'id'", "", 1), "client_secret = 'secret'", "", 1)
+		toml += "[[credentials]]\nname = 'one'\nclient_id = '1'\nclient_secret = 's1'\n"
+		c, err := loadConfig(newTestViper(t, toml))
+		assert.NoError(t, err)
+		assert.Equal(t, []Credential{{Name: "one", ClientId: "1", ClientSecret: "s1"}}, c.Credentials())
+	})
+
+	t.Run("should fail validation", func(t *testing.T) {
+		_, err := loadConfig(newTestViper(t, strings.Replace(validTestConfig, "cache_size = 30", "cache_size = 300", 1)))
+		assert.ErrorContains(t, err, "Config.CacheSize")
+	})
+}
+
+func TestReloadConfig(t *testing.T) {
+	t.Run("should hand a valid config to every reloadable", func(t *testing.T) {
+		var got []int
+		reloadables := []Reloadable{
+			ReloadFunc(func(c Config) { got = append(got, c.CacheSize) }),
+			ReloadFunc(func(c Config) { got = append(got, c.CacheSize) }),
+		}
+		err := reloadConfig(newTestViper(t, strings.Replace(validTestConfig, "cache_size = 30", "cache_size = 10", 1)), reloadables)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{10, 10}, got)
+	})
+
+	t.Run("should reject an invalid config without reloading anything", func(t *testing.T) {
+		called := false
+		reloadables := []Reloadable{ReloadFunc(func(c Config) { called = true })}
+		err := reloadConfig(newTestViper(t, strings.Replace(validTestConfig, "client_id = 'id'", "", 1)), reloadables)
+		assert.Error(t, err)
+		assert.False(t, called)
+	})
+
+	t.Run("should resolve secrets again", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "client_secret")
+		_ = os.WriteFile(path, []byte("rotated\n"), 0600)
+		var got string
+		reloadables := []Reloadable{ReloadFunc(func(c Config) { got = c.ClientSecret })}
+		toml := strings.Replace(validTestConfig, "client_secret = 'secret'", "client_secret = 'file:"+path+"'", 1)
+		err := reloadConfig(newTestViper(t, toml), reloadables)
+		assert.NoError(t, err)
+		assert.Equal(t, "rotated", got)
+	})
+
+	t.Run("should keep the running config when a secret cannot be read", func(t *testing.T) {
+		called := false
+		reloadables := []Reloadable{ReloadFunc(func(c Config) { called = true })}
+		toml := strings.Replace(validTestConfig, "client_secret = 'secret'", "client_secret = 'file:/does/not/exist'", 1)
+		err := reloadConfig(newTestViper(t, toml), reloadables)
+		assert.ErrorContains(t, err, "client_secret")
+		assert.False(t, called)
+	})
+}
+
+func TestConfigEnv(t *testing.T) {
+	t.Run("should load the whole config from the environment", func(t *testing.T) {
+		t.Setenv("ETNOGRABBER_BASE_API_URL", "https://api.soundcloud.com/tracks")
+		t.Setenv("ETNOGRABBER_BASE_AUTH_URL", "https://api.soundcloud.com/oauth2/token")
+		t.Setenv("ETNOGRABBER_CLIENT_ID", "id")
+		t.Setenv("ETNOGRABBER_CLIENT_SECRET", "secret")
+		t.Setenv("ETNOGRABBER_TOKEN_GENERATOR_FALLBACK", "https://fallback.example.com")
+		t.Setenv("ETNOGRABBER_ALLOWED_ORIGINS", "https://a.example.com,https://b.example.com")
+		t.Setenv("ETNOGRABBER_CACHE_SIZE", "10")
+		t.Setenv("ETNOGRABBER_ADDRESS", ":5000")
+		t.Setenv("ETNOGRABBER_INBOUND_RATE_LIMIT_STREAM_IP_BURST", "7")
+		v := viper.New()
+		setConfigDefaults(v)
+		bindConfigEnv(v)
+		c, err := loadConfig(v)
+		assert.NoError(t, err)
+		assert.Equal(t, "secret", c.ClientSecret)
+		assert.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, c.AllowedOrigins)
+		assert.Equal(t, 10, c.CacheSize)
+		assert.Equal(t, 7, c.InboundRateLimit.Stream.IpBurst)
+		assert.Equal(t, 3, c.Retry.MaxAttempts)
+	})
+
+	t.Run("should override the config file", func(t *testing.T) {
+		t.Setenv("ETNOGRABBER_CLIENT_SECRET", "from env")
+		t.Setenv("ETNOGRABBER_RETRY_BASE_DELAY", "1s")
+		v := newTestViper(t, validTestConfig)
+		bindConfigEnv(v)
+		c, err := loadConfig(v)
+		assert.NoError(t, err)
+		assert.Equal(t, "from env", c.ClientSecret)
+		assert.Equal(t, "id", c.ClientId)
+		assert.Equal(t, time.Second, c.Retry.BaseDelay)
+	})
+}
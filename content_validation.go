@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+type ContentValidationConfig struct {
+	MinSize       int    `mapstructure:"min_size" validate:"gte=0"`
+	QuarantineDir string `mapstructure:"quarantine_dir"`
+}
+
+// ContentValidator keeps what is not audio out of the track cache, like an
+// html error page answered with a 200. Rejected content is logged and, with
+// a quarantine dir, saved there for inspection. Only the first rejection of a
+// track is saved, it is not cached and gets downloaded again on every request.
+type ContentValidator struct {
+	c ContentValidationConfig
+}
+
+func NewContentValidator(c ContentValidationConfig) *ContentValidator {
+	return &ContentValidator{c: c}
+}
+
+func (v *ContentValidator) Validate(id int, t Track) error {
+	err := checkTrackContent(t, v.c.MinSize)
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("track %d: not caching invalid content: %v", id, err)
+	if v.c.QuarantineDir != "" {
+		path, qErr := v.quarantine(id, t)
+		switch {
+		case errors.Is(qErr, os.ErrExist):
+		case qErr != nil:
+			log.Printf("track %d: quarantine failed: %v", id, qErr)
+		default:
+			log.Printf("track %d: invalid content quarantined in %s", id, path)
+		}
+	}
+	return err
+}
+
+// quarantine saves t as <id>.bin, failing with os.ErrExist when the track
+// was quarantined already.
+func (v *ContentValidator) quarantine(id int, t Track) (string, error) {
+	if err := os.MkdirAll(v.c.QuarantineDir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(v.c.QuarantineDir, fmt.Sprintf("%d.bin", id))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(t.Data)
+	return path, errors.Join(err, f.Close())
+}
+
+func checkTrackContent(t Track, minSize int) error {
+	if len(t.Data) < minSize {
+		return fmt.Errorf("%d bytes, less than %d", len(t.Data), minSize)
+	}
+	if !hasAudioMagic(t) {
+		return fmt.Errorf("content is not %s", t.ContentType)
+	}
+	return nil
+}
+
+// hasAudioMagic checks the first bytes match the container of the content
+// type, unknown types are let through.
+func hasAudioMagic(t Track) bool {
+	d := t.Data
+	switch t.ContentType {
+	case "audio/mpeg":
+		// an id3 tag or an mpeg frame sync
+		return bytes.HasPrefix(d, []byte("ID3")) || (len(d) >= 2 && d[0] == 0xff && d[1]&0xe0 == 0xe0)
+	case "audio/mp4":
+		return len(d) >= 8 && string(d[4:8]) == "ftyp"
+	case "audio/ogg":
+		return bytes.HasPrefix(d, []byte("OggS"))
+	case "audio/aac":
+		// an adts frame sync
+		return len(d) >= 2 && d[0] == 0xff && d[1]&0xf6 == 0xf0
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContentValidator_Validate(t *testing.T) {
+	validator := NewContentValidator(ContentValidationConfig{MinSize: 4})
+
+	t.Run("should accept audio of the expected container", func(t *testing.T) {
+		assert.NoError(t, validator.Validate(1, Track{Data: []byte("ID3\x04\x00"), ContentType: "audio/mpeg"}))
+		assert.NoError(t, validator.Validate(1, Track{Data: []byte{0xff, 0xfb, 0x90, 0x64}, ContentType: "audio/mpeg"}))
+		assert.NoError(t, validator.Validate(1, Track{Data: []byte("\x00\x00\x00\x18ftypiso6"), ContentType: "audio/mp4"}))
+		assert.NoError(t, validator.Validate(1, Track{Data: []byte("OggS\x00"), ContentType: "audio/ogg"}))
+		assert.NoError(t, validator.Validate(1, Track{Data: []byte{0xff, 0xf1, 0x50, 0x80}, ContentType: "audio/aac"}))
+	})
+
+	t.Run("should reject an html page served as audio", func(t *testing.T) {
+		err := validator.Validate(1, Track{Data: []byte("<html>error</html>"), ContentType: "audio/mpeg"})
+		assert.EqualError(t, err, "content is not audio/mpeg")
+	})
+
+	t.Run("should reject content shorter than the minimum size", func(t *testing.T) {
+		err := validator.Validate(1, Track{Data: []byte("ID3"), ContentType: "audio/mpeg"})
+		assert.EqualError(t, err, "3 bytes, less than 4")
+	})
+
+	t.Run("should quarantine rejected content", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "quarantine")
+		validator := NewContentValidator(ContentValidationConfig{QuarantineDir: dir})
+		assert.Error(t, validator.Validate(42, Track{Data: []byte("<html>"), ContentType: "audio/mpeg"}))
+		files, _ := os.ReadDir(dir)
+		assert.Len(t, files, 1)
+		data, _ := os.ReadFile(filepath.Join(dir, files[0].Name()))
+		assert.Equal(t, []byte("<html>"), data)
+	})
+
+	t.Run("should quarantine a track only once", func(t *testing.T) {
+		dir := t.TempDir()
+		validator := NewContentValidator(ContentValidationConfig{QuarantineDir: dir})
+		assert.Error(t, validator.Validate(42, Track{Data: []byte("<html>"), ContentType: "audio/mpeg"}))
+		assert.Error(t, validator.Validate(42, Track{Data: []byte("<html>again"), ContentType: "audio/mpeg"}))
+		assert.Error(t, validator.Validate(43, Track{Data: []byte("<html>"), ContentType: "audio/mpeg"}))
+		files, _ := os.ReadDir(dir)
+		assert.Len(t, files, 2)
+		data, _ := os.ReadFile(filepath.Join(dir, "42.bin"))
+		assert.Equal(t, []byte("<html>"), data)
+	})
+}
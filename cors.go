@@ -0,0 +1,43 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// AllowedOrigins matches CORS origins against allowed_origins, where * is a
+// wildcard as in echo's own CORS middleware, and can be swapped at runtime.
+type AllowedOrigins struct {
+	patterns atomic.Pointer[[]*regexp.Regexp]
+}
+
+func NewAllowedOrigins(origins []string) *AllowedOrigins {
+	o := &AllowedOrigins{}
+	o.set(origins)
+	return o
+}
+
+func (o *AllowedOrigins) Allow(origin string) (bool, error) {
+	for _, pattern := range *o.patterns.Load() {
+		if pattern.MatchString(origin) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (o *AllowedOrigins) Reload(c Config) {
+	o.set(c.AllowedOrigins)
+}
+
+func (o *AllowedOrigins) set(origins []string) {
+	patterns := make([]*regexp.Regexp, 0, len(origins))
+	for _, origin := range origins {
+		pattern := regexp.QuoteMeta(strings.TrimSpace(origin))
+		pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+		pattern = strings.ReplaceAll(pattern, `\?`, ".")
+		patterns = append(patterns, regexp.MustCompile("^"+pattern+"$"))
+	}
+	o.patterns.Store(&patterns)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAllowedOrigins(t *testing.T) {
+	t.Run("should allow everything with a single wildcard", func(t *testing.T) {
+		allowed, _ := NewAllowedOrigins([]string{"*"}).Allow("https://whatever.example.com")
+		assert.True(t, allowed)
+	})
+
+	t.Run("should match exact origins and wildcard subdomains", func(t *testing.T) {
+		o := NewAllowedOrigins([]string{"https://etnoteam.it", "https://*.example.com"})
+		for origin, want := range map[string]bool{
+			"https://etnoteam.it":         true,
+			"https://etnoteam.it.evil.io": false,
+			"http://etnoteam.it":          false,
+			"https://www.example.com":     true,
+			"https://example.com":         false,
+		} {
+			allowed, _ := o.Allow(origin)
+			assert.Equal(t, want, allowed, origin)
+		}
+	})
+
+	t.Run("should swap the origins on reload", func(t *testing.T) {
+		o := NewAllowedOrigins([]string{"https://etnoteam.it"})
+		o.Reload(Config{AllowedOrigins: []string{"https://new.etnoteam.it"}})
+		allowed, _ := o.Allow("https://etnoteam.it")
+		assert.False(t, allowed)
+		allowed, _ = o.Allow("https://new.etnoteam.it")
+		assert.True(t, allowed)
+	})
+}
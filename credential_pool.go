@@ -0,0 +1,149 @@
+package main
+
+import (
+	"github.com/giorgiovilardo/etnograbber/clock"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Credential struct {
+	Name         string `mapstructure:"name" validate:"required"`
+	ClientId     string `mapstructure:"client_id" validate:"required"`
+	ClientSecret string `mapstructure:"client_secret" validate:"required"`
+}
+
+// CredentialPool hands out tokens of several credentials in turn, each with
+// its own token repository, so every credential spends its own rate limit
+// and grant quota. A credential that gets rate limited, rejected or cannot
+// get a token sits out for a while; when all of them do, the one coming
+// back first is used anyway.
+type CredentialPool struct {
+	clock    clock.Clock
+	cooldown time.Duration
+	mu       sync.Mutex
+	members  []*poolMember
+	next     int
+	byToken  map[string]*poolMember
+}
+
+type poolMember struct {
+	name         string
+	tokens       CredentialTokenRepository
+	accessToken  string
+	benchedUntil time.Time
+}
+
+// NewCredentialPool gets the token repository of each credential from tokens,
+// see CredentialTokens.
+func NewCredentialPool(credentials []Credential, tokens func(c Credential) CredentialTokenRepository, clock clock.Clock, cooldown time.Duration) *CredentialPool {
+	p := &CredentialPool{clock: clock, cooldown: cooldown, byToken: make(map[string]*poolMember)}
+	for _, c := range credentials {
+		p.members = append(p.members, &poolMember{name: c.Name, tokens: tokens(c)})
+	}
+	return p
+}
+
+// CredentialTokens gives each credential a token repository of its own
+// asking SoundCloud through api.
+func CredentialTokens(api CredentialApi, clock clock.Clock) func(c Credential) CredentialTokenRepository {
+	return func(c Credential) CredentialTokenRepository {
+		return NewHttpTokenRepository(clock, api.ForCredential(c))
+	}
+}
+
+func (p *CredentialPool) GetToken() (Token, error) {
+	m := p.pick()
+	t, err := m.tokens.GetToken()
+	if err != nil {
+		p.bench(m, p.cooldown, "no token: "+err.Error())
+		return Token{}, err
+	}
+
+	p.mu.Lock()
+	if t.AccessToken != m.accessToken {
+		delete(p.byToken, m.accessToken)
+		m.accessToken = t.AccessToken
+		p.byToken[t.AccessToken] = m
+	}
+	p.mu.Unlock()
+	return t, nil
+}
+
+// PeekToken shows the credential token that lasts longest, expired or not.
+func (p *CredentialPool) PeekToken() Token {
+	var best Token
+	for _, m := range p.members {
+		if t := m.tokens.PeekToken(); t.AccessToken != "" && (best.AccessToken == "" || t.ExpiresAt.After(best.ExpiresAt)) {
+			best = t
+		}
+	}
+	return best
+}
+
+// ObserveResponse benches the credential whose token got a rate limit or a
+// 401, the latter also dropping the token. Rate limits are reported handled
+// when another credential can take over.
+func (p *CredentialPool) ObserveResponse(req *http.Request, res *http.Response) bool {
+	accessToken := strings.TrimPrefix(req.Header.Get("Authorization"), "OAuth ")
+	if accessToken == "" {
+		return false
+	}
+	p.mu.Lock()
+	m, ok := p.byToken[accessToken]
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		m.tokens.Invalidate()
+		p.bench(m, p.cooldown, "token rejected")
+		return false
+	}
+
+	wait, limited := rateLimitWait(res, p.clock.Now())
+	if !limited {
+		return false
+	}
+	if wait <= 0 {
+		wait = p.cooldown
+	}
+	p.bench(m, wait, "rate limited")
+	return len(p.members) > 1
+}
+
+func (p *CredentialPool) pick() *poolMember {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.clock.Now()
+	for i := 0; i < len(p.members); i++ {
+		m := p.members[(p.next+i)%len(p.members)]
+		if !m.benchedUntil.After(now) {
+			p.next = (p.next + i + 1) % len(p.members)
+			return m
+		}
+	}
+
+	first := p.members[0]
+	for _, m := range p.members[1:] {
+		if m.benchedUntil.Before(first.benchedUntil) {
+			first = m
+		}
+	}
+	return first
+}
+
+func (p *CredentialPool) bench(m *poolMember, d time.Duration, reason string) {
+	if len(p.members) == 1 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if until := p.clock.Now().Add(d); until.After(m.benchedUntil) {
+		m.benchedUntil = until
+		log.Printf("credential %s out of rotation for %s, %s", m.name, d, reason)
+	}
+}
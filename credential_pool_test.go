@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type mockCredentialApi map[string]*mockSoundcloudApi
+
+func (m mockCredentialApi) ForCredential(c Credential) SoundcloudApi {
+	return m[c.Name]
+}
+
+func newMockCredentialApi(names ...string) mockCredentialApi {
+	m := mockCredentialApi{}
+	for _, name := range names {
+		m[name] = &mockSoundcloudApi{thatReturns: []byte(fmt.Sprintf(`{"access_token":"%s","expires_in":3599,"refresh_token":"bau","scope":"","token_type":"bearer"}`, name))}
+	}
+	return m
+}
+
+func newCredentialPoolForTest(api mockCredentialApi, names ...string) (*CredentialPool, *mockClock) {
+	var credentials []Credential
+	for _, name := range names {
+		credentials = append(credentials, Credential{Name: name})
+	}
+	clock := newMockClock()
+	return NewCredentialPool(credentials, CredentialTokens(api, clock), clock, time.Minute*10), clock
+}
+
+func upstreamAnswer(accessToken string, status int, headers http.Header) (*http.Request, *http.Response) {
+	req, _ := http.NewRequest(http.MethodGet, "https://api.soundcloud.com/tracks/1", nil)
+	req.Header.Set("Authorization", "OAuth "+accessToken)
+	if headers == nil {
+		headers = http.Header{}
+	}
+	return req, &http.Response{StatusCode: status, Header: headers}
+}
+
+func tokensFrom(p *CredentialPool, n int) []string {
+	var got []string
+	for i := 0; i < n; i++ {
+		t, _ := p.GetToken()
+		got = append(got, t.AccessToken)
+	}
+	return got
+}
+
+func TestCredentialPool(t *testing.T) {
+	t.Run("should take turns between credentials", func(t *testing.T) {
+		p, _ := newCredentialPoolForTest(newMockCredentialApi("a", "b"), "a", "b")
+		assert.Equal(t, []string{"a", "b", "a", "b"}, tokensFrom(p, 4))
+	})
+
+	t.Run("should bench a rate limited credential for what upstream asked", func(t *testing.T) {
+		p, clock := newCredentialPoolForTest(newMockCredentialApi("a", "b"), "a", "b")
+		tokensFrom(p, 2)
+		handled := p.ObserveResponse(upstreamAnswer("a", http.StatusTooManyRequests, http.Header{"Retry-After": {"60"}}))
+		assert.True(t, handled)
+		assert.Equal(t, []string{"b", "b"}, tokensFrom(p, 2))
+		clock.Sleep(time.Second * 61)
+		assert.ElementsMatch(t, []string{"a", "b"}, tokensFrom(p, 2))
+	})
+
+	t.Run("should drop a rejected token and bench its credential", func(t *testing.T) {
+		api := newMockCredentialApi("a", "b")
+		p, clock := newCredentialPoolForTest(api, "a", "b")
+		tokensFrom(p, 2)
+		assert.False(t, p.ObserveResponse(upstreamAnswer("a", http.StatusUnauthorized, nil)))
+		assert.Equal(t, []string{"b", "b"}, tokensFrom(p, 2))
+		clock.Sleep(time.Minute * 11)
+		tokensFrom(p, 2)
+		assert.Equal(t, 2, api["a"].Calls)
+	})
+
+	t.Run("should bench a credential that cannot get a token", func(t *testing.T) {
+		api := newMockCredentialApi("a", "b")
+		api["a"].wantErr = true
+		api["a"].errMsg = "invalid_client"
+		p, _ := newCredentialPoolForTest(api, "a", "b")
+		_, err := p.GetToken()
+		assert.EqualError(t, err, "invalid_client")
+		assert.Equal(t, []string{"b", "b"}, tokensFrom(p, 2))
+	})
+
+	t.Run("should use the credential coming back first when all are benched", func(t *testing.T) {
+		p, _ := newCredentialPoolForTest(newMockCredentialApi("a", "b"), "a", "b")
+		tokensFrom(p, 2)
+		p.ObserveResponse(upstreamAnswer("a", http.StatusTooManyRequests, http.Header{"Retry-After": {"120"}}))
+		p.ObserveResponse(upstreamAnswer("b", http.StatusTooManyRequests, http.Header{"Retry-After": {"60"}}))
+		assert.Equal(t, []string{"b", "b"}, tokensFrom(p, 2))
+	})
+
+	t.Run("should leave rate limits to the upstream limiter with a single credential", func(t *testing.T) {
+		p, _ := newCredentialPoolForTest(newMockCredentialApi("a"), "a")
+		tokensFrom(p, 1)
+		assert.False(t, p.ObserveResponse(upstreamAnswer("a", http.StatusTooManyRequests, nil)))
+		assert.Equal(t, []string{"a"}, tokensFrom(p, 1))
+	})
+
+	t.Run("should ignore answers to unknown tokens", func(t *testing.T) {
+		p, _ := newCredentialPoolForTest(newMockCredentialApi("a", "b"), "a", "b")
+		assert.False(t, p.ObserveResponse(upstreamAnswer("stale", http.StatusTooManyRequests, nil)))
+		assert.False(t, p.ObserveResponse(upstreamAnswer("", http.StatusTooManyRequests, nil)))
+	})
+
+	t.Run("should peek at the held tokens without getting one", func(t *testing.T) {
+		api := newMockCredentialApi("a", "b")
+		p, _ := newCredentialPoolForTest(api, "a", "b")
+		assert.Equal(t, Token{}, p.PeekToken())
+		tokensFrom(p, 1)
+		assert.Equal(t, "a", p.PeekToken().AccessToken)
+		assert.Equal(t, 1, api["a"].Calls+api["b"].Calls)
+	})
+}
+
+func TestConfig_Credentials(t *testing.T) {
+	t.Run("should default to client_id and client_secret", func(t *testing.T) {
+		c := Config{ClientId: "id", ClientSecret: "secret"}
+		assert.Equal(t, []Credential{{Name: "default", ClientId: "id", ClientSecret: "secret"}}, c.Credentials())
+	})
+
+	t.Run("should prefer the credentials list", func(t *testing.T) {
+		credentials := []Credential{{Name: "one", ClientId: "1", ClientSecret: "s1"}, {Name: "two", ClientId: "2", ClientSecret: "s2"}}
+		assert.Equal(t, credentials, Config{ClientId: "id", ClientCredentials: credentials}.Credentials())
+	})
+}
@@ -0,0 +1,29 @@
+package main
+
+import "time"
+
+// ServiceError is what services hand to handlers: the message is shown to
+// api clients, the cause stays reachable through errors.Is and errors.As.
+type ServiceError struct {
+	message string
+	cause   error
+}
+
+func newServiceError(message string, cause error) *ServiceError {
+	return &ServiceError{message: message, cause: cause}
+}
+
+func (e *ServiceError) Error() string {
+	return e.message
+}
+
+func (e *ServiceError) Unwrap() error {
+	return e.cause
+}
+
+// retryAfterError is implemented by errors after which clients should wait
+// before trying again.
+type retryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"github.com/labstack/echo/v4"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
 )
 
@@ -13,6 +16,34 @@ func HealthHandler(c echo.Context) error {
 	})
 }
 
+// ReadyHandler runs every check and answers 503 with the failing ones
+// if any of them fails, degraded ones are listed but keep it ready.
+func ReadyHandler(checks map[string]ReadinessCheck) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		status := http.StatusOK
+		results := make(map[string]map[string]string, len(checks))
+		for name, check := range checks {
+			err := check()
+			var degraded *degradedError
+			if errors.As(err, &degraded) {
+				results[name] = map[string]string{"status": "degraded", "error": err.Error()}
+				continue
+			}
+			if err != nil {
+				status = http.StatusServiceUnavailable
+				results[name] = map[string]string{"status": "fail", "error": err.Error()}
+				continue
+			}
+			results[name] = map[string]string{"status": "ok"}
+		}
+
+		return c.JSON(status, map[string]interface{}{
+			"ready":  status == http.StatusOK,
+			"checks": results,
+		})
+	}
+}
+
 func TrackDataHandler(s TrackDataService) func(c echo.Context) error {
 	return func(c echo.Context) error {
 		trackId, err := strconv.Atoi(c.Param("trackId"))
@@ -22,7 +53,7 @@ func TrackDataHandler(s TrackDataService) func(c echo.Context) error {
 
 		track, err := s.GetTrackData(trackId)
 		if err != nil {
-			return apiError(c, err.Error())
+			return apiServiceError(c, err)
 		}
 
 		return c.JSON(http.StatusOK, track)
@@ -38,10 +69,69 @@ func TrackHandler(s TrackService) func(c echo.Context) error {
 
 		track, err := s.GetTrack(trackId)
 		if err != nil {
-			return apiError(c, err.Error())
+			return apiServiceError(c, err)
 		}
 
-		return c.Stream(http.StatusOK, "audio/mpeg", bytes.NewReader(track))
+		return c.Stream(http.StatusOK, track.ContentType, bytes.NewReader(track.Data))
+	}
+}
+
+func TrackRedirectHandler(s TrackUrlService) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		trackId, err := strconv.Atoi(c.Param("trackId"))
+		if err != nil {
+			return apiError(c, trackIdNotANumber)
+		}
+
+		trackUrl, err := s.GetTrackUrl(trackId)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.Redirect(http.StatusFound, trackUrl)
+	}
+}
+
+func HlsPlaylistHandler(s HlsService) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		trackId, err := strconv.Atoi(c.Param("trackId"))
+		if err != nil {
+			return apiError(c, trackIdNotANumber)
+		}
+
+		playlist, err := s.GetPlaylist(trackId)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+		query := url.Values{}
+		if sig := c.QueryParam("sig"); sig != "" {
+			query.Set("exp", c.QueryParam("exp"))
+			query.Set("sig", sig)
+		}
+		if key := c.QueryParam("api_key"); key != "" {
+			query.Set("api_key", key)
+		}
+		if len(query) > 0 {
+			playlist = appendHlsQuery(playlist, query.Encode())
+		}
+
+		return c.Blob(http.StatusOK, hlsPlaylistContentType, playlist)
+	}
+}
+
+func HlsSegmentHandler(s HlsService) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		trackId, err := strconv.Atoi(c.Param("trackId"))
+		if err != nil {
+			return apiError(c, trackIdNotANumber)
+		}
+
+		segment, err := s.GetSegment(trackId, c.Param("segment"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.Blob(http.StatusOK, segment.ContentType, segment.Data)
 	}
 }
 
@@ -49,4 +139,17 @@ func apiError(c echo.Context, message string) error {
 	return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": message})
 }
 
+// apiServiceError tells clients when to come back if the failure is one
+// that goes away by itself, like an open circuit.
+func apiServiceError(c echo.Context, err error) error {
+	var retryable retryAfterError
+	if errors.As(err, &retryable) {
+		seconds := int(math.Ceil(retryable.RetryAfter().Seconds()))
+		c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	return apiError(c, err.Error())
+}
+
 const trackIdNotANumber = "trackId not a number"
+
+const hlsPlaylistContentType = "application/vnd.apple.mpegurl"
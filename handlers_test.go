@@ -2,12 +2,14 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestHealthHandler(t *testing.T) {
@@ -24,6 +26,35 @@ func TestHealthHandler(t *testing.T) {
 	})
 }
 
+func TestReadyHandler(t *testing.T) {
+	ready := func(checks map[string]ReadinessCheck) *httptest.ResponseRecorder {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/health/ready", nil)
+		rec := httptest.NewRecorder()
+		_ = ReadyHandler(checks)(e.NewContext(req, rec))
+		return rec
+	}
+	passing := func() error { return nil }
+
+	t.Run("should be ready when every check passes", func(t *testing.T) {
+		rec := ready(map[string]ReadinessCheck{"token": passing, "cache": passing})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"ready":true,"checks":{"token":{"status":"ok"},"cache":{"status":"ok"}}}`, rec.Body.String())
+	})
+
+	t.Run("should answer 503 with the failing checks", func(t *testing.T) {
+		rec := ready(map[string]ReadinessCheck{"token": passing, "upstream": func() error { return errors.New("circuit open") }})
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.JSONEq(t, `{"ready":false,"checks":{"token":{"status":"ok"},"upstream":{"status":"fail","error":"circuit open"}}}`, rec.Body.String())
+	})
+
+	t.Run("should stay ready with degraded checks", func(t *testing.T) {
+		rec := ready(map[string]ReadinessCheck{"token": passing, "cache": func() error { return &degradedError{err: errors.New("connection refused")} }})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"ready":true,"checks":{"token":{"status":"ok"},"cache":{"status":"degraded","error":"connection refused"}}}`, rec.Body.String())
+	})
+}
+
 func TestTrackDataHandler(t *testing.T) {
 	setupEcho := func(trackId string) (echo.Context, *httptest.ResponseRecorder) {
 		e := echo.New()
@@ -95,6 +126,14 @@ func TestTrackHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("should use the content-type of the chosen transcoding", func(t *testing.T) {
+		c, r := setupEcho("1234")
+		if assert.NoError(t, TrackHandler(mockTrackService{contentType: "audio/ogg"})(c)) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, "audio/ogg", r.Header().Get("Content-Type"))
+		}
+	})
+
 	t.Run("should fail if path param is non int castable", func(t *testing.T) {
 		expectedResponseBody := `{"error":"trackId not a number"}`
 		c, r := setupEcho("aba")
@@ -113,6 +152,26 @@ func TestTrackHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("should tell clients when to retry if the circuit is open", func(t *testing.T) {
+		expectedResponseBody := `{"error":"track not available"}`
+		c, r := setupEcho("1234")
+		err := newServiceError("track not available", &CircuitOpenError{wait: time.Millisecond * 12500})
+		if assert.NoError(t, TrackHandler(mockTrackService{err: err})(c)) {
+			assert.Equal(t, http.StatusServiceUnavailable, r.Code)
+			assert.Equal(t, "13", r.Header().Get("Retry-After"))
+			assert.Equal(t, expectedResponseBody, strings.Trim(r.Body.String(), "\n"))
+		}
+	})
+
+	t.Run("should tell clients when to retry if upstream rate limits us", func(t *testing.T) {
+		c, r := setupEcho("1234")
+		err := newServiceError("track not available", errors.Join(errors.New("failed to get track stream"), &RateLimitedError{wait: time.Minute}))
+		if assert.NoError(t, TrackHandler(mockTrackService{err: err})(c)) {
+			assert.Equal(t, http.StatusServiceUnavailable, r.Code)
+			assert.Equal(t, "60", r.Header().Get("Retry-After"))
+		}
+	})
+
 	t.Run("should fail if it can't read track stream", func(t *testing.T) {
 		expectedResponseBody := `{"error":"track not available"}`
 		c, r := setupEcho("1234")
@@ -123,6 +182,138 @@ func TestTrackHandler(t *testing.T) {
 	})
 }
 
+func TestTrackRedirectHandler(t *testing.T) {
+	setupEcho := func(trackId string) (echo.Context, *httptest.ResponseRecorder) {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/"+trackId+"/stream", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/:trackId/stream")
+		c.SetParamNames("trackId")
+		c.SetParamValues(trackId)
+		return c, rec
+	}
+
+	t.Run("should redirect to the url the service returns", func(t *testing.T) {
+		c, r := setupEcho("1234")
+		if assert.NoError(t, TrackRedirectHandler(mockTrackUrlService{})(c)) {
+			assert.Equal(t, http.StatusFound, r.Code)
+			assert.Equal(t, "https://cdn/1234", r.Header().Get("Location"))
+		}
+	})
+
+	t.Run("should fail if path param is non int castable", func(t *testing.T) {
+		expectedResponseBody := `{"error":"trackId not a number"}`
+		c, r := setupEcho("aba")
+		if assert.NoError(t, TrackRedirectHandler(mockTrackUrlService{})(c)) {
+			assert.Equal(t, http.StatusServiceUnavailable, r.Code)
+			assert.Equal(t, expectedResponseBody, strings.Trim(r.Body.String(), "\n"))
+		}
+	})
+
+	t.Run("should fail if it can't get the track url", func(t *testing.T) {
+		expectedResponseBody := `{"error":"track url not available"}`
+		c, r := setupEcho("1234")
+		if assert.NoError(t, TrackRedirectHandler(mockTrackUrlService{wantErr: true, errMsg: "track url not available"})(c)) {
+			assert.Equal(t, http.StatusServiceUnavailable, r.Code)
+			assert.Equal(t, expectedResponseBody, strings.Trim(r.Body.String(), "\n"))
+		}
+	})
+}
+
+func TestHlsHandlers(t *testing.T) {
+	setupEcho := func(path string, names []string, values []string) (echo.Context, *httptest.ResponseRecorder) {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath(path)
+		c.SetParamNames(names...)
+		c.SetParamValues(values...)
+		return c, rec
+	}
+
+	t.Run("should serve the playlist as an m3u8", func(t *testing.T) {
+		c, r := setupEcho("/:trackId/hls/playlist.m3u8", []string{"trackId"}, []string{"1234"})
+		if assert.NoError(t, HlsPlaylistHandler(mockHlsService{})(c)) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, "application/vnd.apple.mpegurl", r.Header().Get("Content-Type"))
+			assert.Equal(t, "#EXTM3U\n", r.Body.String())
+		}
+	})
+
+	t.Run("should carry the signature and the api key over to the segments", func(t *testing.T) {
+		c, r := setupEcho("/:trackId/hls/playlist.m3u8", []string{"trackId"}, []string{"1234"})
+		c.Request().URL.RawQuery = "exp=1&sig=abc&api_key=k%26y"
+		service := mockHlsService{playlist: "#EXTM3U\n#EXTINF:10,\nsegments/0\n"}
+		if assert.NoError(t, HlsPlaylistHandler(service)(c)) {
+			assert.Equal(t, "#EXTM3U\n#EXTINF:10,\nsegments/0?api_key=k%26y&exp=1&sig=abc\n", r.Body.String())
+		}
+	})
+
+	t.Run("should serve segments with their content-type", func(t *testing.T) {
+		c, r := setupEcho("/:trackId/hls/segments/:segment", []string{"trackId", "segment"}, []string{"1234", "3"})
+		if assert.NoError(t, HlsSegmentHandler(mockHlsService{})(c)) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, "audio/mp4", r.Header().Get("Content-Type"))
+			assert.Equal(t, "1234/3", r.Body.String())
+		}
+	})
+
+	t.Run("should fail if path param is non int castable", func(t *testing.T) {
+		expectedResponseBody := `{"error":"trackId not a number"}`
+		c, r := setupEcho("/:trackId/hls/playlist.m3u8", []string{"trackId"}, []string{"aba"})
+		if assert.NoError(t, HlsPlaylistHandler(mockHlsService{})(c)) {
+			assert.Equal(t, http.StatusServiceUnavailable, r.Code)
+			assert.Equal(t, expectedResponseBody, strings.Trim(r.Body.String(), "\n"))
+		}
+	})
+
+	t.Run("should fail if the service fails", func(t *testing.T) {
+		expectedResponseBody := `{"error":"hls segment not available"}`
+		c, r := setupEcho("/:trackId/hls/segments/:segment", []string{"trackId", "segment"}, []string{"1234", "3"})
+		if assert.NoError(t, HlsSegmentHandler(mockHlsService{wantErr: true, errMsg: "hls segment not available"})(c)) {
+			assert.Equal(t, http.StatusServiceUnavailable, r.Code)
+			assert.Equal(t, expectedResponseBody, strings.Trim(r.Body.String(), "\n"))
+		}
+	})
+}
+
+type mockHlsService struct {
+	wantErr  bool
+	errMsg   string
+	playlist string
+}
+
+func (m mockHlsService) GetPlaylist(_ int) ([]byte, error) {
+	if m.wantErr {
+		return nil, errors.New(m.errMsg)
+	}
+	if m.playlist != "" {
+		return []byte(m.playlist), nil
+	}
+	return []byte("#EXTM3U\n"), nil
+}
+
+func (m mockHlsService) GetSegment(id int, segment string) (Track, error) {
+	if m.wantErr {
+		return Track{}, errors.New(m.errMsg)
+	}
+	return Track{Data: []byte(fmt.Sprintf("%d/%s", id, segment)), ContentType: "audio/mp4"}, nil
+}
+
+type mockTrackUrlService struct {
+	wantErr bool
+	errMsg  string
+}
+
+func (m mockTrackUrlService) GetTrackUrl(id int) (string, error) {
+	if m.wantErr {
+		return "", errors.New(m.errMsg)
+	}
+	return fmt.Sprintf("https://cdn/%d", id), nil
+}
+
 type mockTrackDataService struct {
 	wantErr bool
 	errMsg  string
@@ -142,15 +333,24 @@ func newFailingMockTrackDataService(errMsg string) *mockTrackDataService {
 }
 
 type mockTrackService struct {
-	wantErr bool
-	errMsg  string
+	wantErr     bool
+	errMsg      string
+	err         error
+	contentType string
 }
 
-func (m mockTrackService) GetTrack(_ int) ([]byte, error) {
+func (m mockTrackService) GetTrack(_ int) (Track, error) {
+	if m.err != nil {
+		return Track{}, m.err
+	}
 	if m.wantErr {
-		return nil, errors.New(m.errMsg)
+		return Track{}, errors.New(m.errMsg)
+	}
+	contentType := m.contentType
+	if contentType == "" {
+		contentType = "audio/mpeg"
 	}
-	return []byte(`yolo`), nil
+	return Track{Data: []byte(`yolo`), ContentType: contentType}, nil
 }
 
 func newFailingMockTrackService(errMsg string) *mockTrackService {
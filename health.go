@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/giorgiovilardo/etnograbber/clock"
+	"sync/atomic"
+	"time"
+)
+
+// ReadinessCheck tells why a dependency is not ready, nil when it is.
+type ReadinessCheck func() error
+
+// degradedError is what a check returns for a failure the instance works
+// around, reported without failing readiness.
+type degradedError struct {
+	err error
+}
+
+func (e *degradedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *degradedError) Unwrap() error {
+	return e.err
+}
+
+// Pinger is implemented by caches living outside the process, which can
+// become unreachable.
+type Pinger interface {
+	Ping() error
+}
+
+// TokenCheck looks at the token the repository holds and never waits for one.
+// A missing or expired token fails the check and gets renewed in the
+// background, one renewal at a time, so an idle instance that nobody asked
+// for a token lately comes back by the next probe.
+func TokenCheck(r PeekableTokenRepository, clock clock.Clock) ReadinessCheck {
+	var renewing atomic.Bool
+	return func() error {
+		t := r.PeekToken()
+		if t.AccessToken != "" && !t.IsExpired(clock) {
+			return nil
+		}
+		if renewing.CompareAndSwap(false, true) {
+			go func() {
+				defer renewing.Store(false)
+				_, _ = r.GetToken()
+			}()
+		}
+		if t.AccessToken == "" {
+			return errors.New("no token yet")
+		}
+		return errors.New("token expired")
+	}
+}
+
+// UpstreamCheck fails while the circuit breaker is open or SoundCloud asked
+// us to back off.
+func UpstreamCheck(b *CircuitBreaker, l *UpstreamLimiter) ReadinessCheck {
+	return func() error {
+		if state := b.State(); state == CircuitOpen {
+			return fmt.Errorf("circuit %s", state)
+		}
+		if wait := l.PausedFor(); wait > 0 {
+			return fmt.Errorf("rate limited by upstream for %s", wait.Round(time.Second))
+		}
+		return nil
+	}
+}
+
+// CacheCheck pings cache when it lives outside the process, in-process
+// caches are always reachable. An unreachable cache only degrades the
+// instance, which keeps serving from its in-memory caches: failing every
+// replica at once over a redis blip would take the whole fleet down.
+func CacheCheck(cache any) ReadinessCheck {
+	return func() error {
+		if p, ok := cache.(Pinger); ok {
+			if err := p.Ping(); err != nil {
+				return &degradedError{err: err}
+			}
+		}
+		return nil
+	}
+}
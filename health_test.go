@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type mockTokenSource func() (Token, error)
+
+func (m mockTokenSource) GetToken() (Token, error) {
+	return m()
+}
+
+// mockPeekableTokens holds token and counts the GetToken calls, which block
+// until release is closed.
+type mockPeekableTokens struct {
+	token   Token
+	release chan struct{}
+	gets    atomic.Int32
+}
+
+func (m *mockPeekableTokens) GetToken() (Token, error) {
+	m.gets.Add(1)
+	<-m.release
+	return m.token, nil
+}
+
+func (m *mockPeekableTokens) PeekToken() Token {
+	return m.token
+}
+
+type mockPinger struct {
+	err error
+}
+
+func (m mockPinger) Ping() error {
+	return m.err
+}
+
+func TestTokenCheck(t *testing.T) {
+	clock := newMockClock()
+
+	t.Run("should pass with a valid token without getting one", func(t *testing.T) {
+		tokens := &mockPeekableTokens{token: Token{AccessToken: "a", ExpiresAt: clock.Now().Add(time.Hour)}, release: make(chan struct{})}
+		assert.NoError(t, TokenCheck(tokens, clock)())
+		assert.Equal(t, int32(0), tokens.gets.Load())
+	})
+
+	t.Run("should fail with an expired token", func(t *testing.T) {
+		tokens := &mockPeekableTokens{token: Token{AccessToken: "a", ExpiresAt: clock.Now().Add(-time.Hour)}, release: make(chan struct{})}
+		defer close(tokens.release)
+		assert.EqualError(t, TokenCheck(tokens, clock)(), "token expired")
+	})
+
+	t.Run("should fail without a token", func(t *testing.T) {
+		tokens := &mockPeekableTokens{release: make(chan struct{})}
+		defer close(tokens.release)
+		assert.EqualError(t, TokenCheck(tokens, clock)(), "no token yet")
+	})
+
+	t.Run("should renew in the background without waiting, once at a time", func(t *testing.T) {
+		tokens := &mockPeekableTokens{release: make(chan struct{})}
+		check := TokenCheck(tokens, clock)
+		assert.Error(t, check())
+		assert.Eventually(t, func() bool { return tokens.gets.Load() == 1 }, time.Second, time.Millisecond)
+		assert.Error(t, check())
+		assert.Equal(t, int32(1), tokens.gets.Load())
+		close(tokens.release)
+		assert.Eventually(t, func() bool {
+			_ = check()
+			return tokens.gets.Load() == 2
+		}, time.Second, time.Millisecond)
+	})
+}
+
+func TestUpstreamCheck(t *testing.T) {
+	t.Run("should fail while the circuit is open", func(t *testing.T) {
+		clock := newMockClock()
+		b := NewCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute}, clock)
+		check := UpstreamCheck(b, NewUpstreamLimiter(UpstreamRateLimitConfig{}, clock))
+		assert.NoError(t, check())
+		b.Failure()
+		assert.EqualError(t, check(), "circuit open")
+	})
+
+	t.Run("should fail while paused by upstream", func(t *testing.T) {
+		clock := newMockClock()
+		l := NewUpstreamLimiter(UpstreamRateLimitConfig{}, clock)
+		l.Observe(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"120"}}})
+		check := UpstreamCheck(NewCircuitBreaker(CircuitBreakerConfig{}, clock), l)
+		assert.EqualError(t, check(), "rate limited by upstream for 2m0s")
+	})
+}
+
+func TestCacheCheck(t *testing.T) {
+	t.Run("should pass for in-process caches", func(t *testing.T) {
+		assert.NoError(t, CacheCheck(&mockLruCache{})())
+	})
+
+	t.Run("should report unreachable remote caches as degraded", func(t *testing.T) {
+		assert.NoError(t, CacheCheck(mockPinger{})())
+		err := CacheCheck(mockPinger{err: errors.New("connection refused")})()
+		assert.EqualError(t, err, "connection refused")
+		var degraded *degradedError
+		assert.ErrorAs(t, err, &degraded)
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const hlsInitSegment = "init"
+
+type HlsPlaylist struct {
+	Url         string
+	Body        []byte
+	ContentType string
+}
+
+type hlsMediaPlaylist struct {
+	initSegment string
+	segments    []string
+}
+
+// parseHlsPlaylist extracts the media segments (and the EXT-X-MAP init
+// segment, if any) of a media playlist, resolved against its own url.
+func parseHlsPlaylist(body []byte, base *url.URL) (hlsMediaPlaylist, error) {
+	var p hlsMediaPlaylist
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "#EXTM3U" {
+		return hlsMediaPlaylist{}, errors.New("not an m3u8 playlist")
+	}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			uri, ok := hlsAttribute(line, "URI")
+			if !ok {
+				return hlsMediaPlaylist{}, errors.New("EXT-X-MAP without URI")
+			}
+			resolved, err := base.Parse(uri)
+			if err != nil {
+				return hlsMediaPlaylist{}, err
+			}
+			p.initSegment = resolved.String()
+		case strings.HasPrefix(line, "#"):
+		default:
+			resolved, err := base.Parse(line)
+			if err != nil {
+				return hlsMediaPlaylist{}, err
+			}
+			p.segments = append(p.segments, resolved.String())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return hlsMediaPlaylist{}, err
+	}
+	if len(p.segments) == 0 {
+		return hlsMediaPlaylist{}, errors.New("playlist has no segments")
+	}
+	return p, nil
+}
+
+func hlsAttribute(line string, name string) (string, bool) {
+	_, attributes, _ := strings.Cut(line, ":")
+	quoted := false
+	fields := strings.FieldsFunc(attributes, func(r rune) bool {
+		if r == '"' {
+			quoted = !quoted
+		}
+		return r == ',' && !quoted
+	})
+	for _, attribute := range fields {
+		key, value, found := strings.Cut(attribute, "=")
+		if found && key == name {
+			return strings.Trim(value, `"`), true
+		}
+	}
+	return "", false
+}
+
+// segmentUrl maps a segment name produced by rewriteHlsPlaylist back to
+// the upstream url it replaced.
+func (p hlsMediaPlaylist) segmentUrl(segment string) (string, error) {
+	if segment == hlsInitSegment {
+		if p.initSegment == "" {
+			return "", errors.New("playlist has no init segment")
+		}
+		return p.initSegment, nil
+	}
+	n, err := strconv.Atoi(segment)
+	if err != nil || n < 0 || n >= len(p.segments) {
+		return "", fmt.Errorf("segment %s not in playlist", segment)
+	}
+	return p.segments[n], nil
+}
+
+// rewriteHlsPlaylist points the segments of a media playlist to the
+// segments/ route next to the proxied playlist, so signed upstream urls
+// never reach the client. Segments are numbered in playlist order.
+func rewriteHlsPlaylist(body []byte) ([]byte, error) {
+	var result bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "#EXTM3U" {
+		return nil, errors.New("not an m3u8 playlist")
+	}
+	result.WriteString("#EXTM3U\n")
+	n := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			line = replaceHlsUri(line, "segments/"+hlsInitSegment)
+		case !strings.HasPrefix(line, "#"):
+			line = fmt.Sprintf("segments/%d", n)
+			n++
+		}
+		result.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result.Bytes(), nil
+}
+
+// appendHlsQuery appends query to the segments of the rewritten playlist,
+// so they carry the signature or the api key the playlist was asked with:
+// players cannot add them on their own.
+func appendHlsQuery(playlist []byte, query string) []byte {
+	var result bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			if uri, ok := hlsAttribute(line, "URI"); ok {
+				line = replaceHlsUri(line, uri+"?"+query)
+			}
+		case line != "" && !strings.HasPrefix(line, "#"):
+			line += "?" + query
+		}
+		result.WriteString(line + "\n")
+	}
+	return result.Bytes()
+}
+
+func replaceHlsUri(line string, uri string) string {
+	start := strings.Index(line, `URI="`)
+	if start == -1 {
+		return line
+	}
+	start += len(`URI="`)
+	end := strings.Index(line[start:], `"`)
+	if end == -1 {
+		return line
+	}
+	return line[:start] + uri + line[start+end:]
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+)
+
+func TestParseHlsPlaylist(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/media/playlist.m3u8?sig=1")
+
+	t.Run("should resolve segments against the playlist url", func(t *testing.T) {
+		body := []byte("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\nseg0.mp3\n#EXTINF:10,\n/abs/seg1.mp3\n#EXTINF:10,\nhttps://other.example.com/seg2.mp3\n#EXT-X-ENDLIST\n")
+		got, err := parseHlsPlaylist(body, base)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			"https://cdn.example.com/media/seg0.mp3",
+			"https://cdn.example.com/abs/seg1.mp3",
+			"https://other.example.com/seg2.mp3",
+		}, got.segments)
+		assert.Empty(t, got.initSegment)
+	})
+
+	t.Run("should read the init segment from EXT-X-MAP", func(t *testing.T) {
+		body := []byte("#EXTM3U\n#EXT-X-MAP:URI=\"init,v1.mp4\",BYTERANGE=\"10@0\"\n#EXTINF:10,\nseg0.m4s\n")
+		got, err := parseHlsPlaylist(body, base)
+		assert.NoError(t, err)
+		assert.Equal(t, "https://cdn.example.com/media/init,v1.mp4", got.initSegment)
+	})
+
+	t.Run("should fail if the body is not a playlist", func(t *testing.T) {
+		_, err := parseHlsPlaylist([]byte("<html></html>"), base)
+		assert.EqualError(t, err, "not an m3u8 playlist")
+	})
+
+	t.Run("should fail if the playlist has no segments", func(t *testing.T) {
+		_, err := parseHlsPlaylist([]byte("#EXTM3U\n#EXT-X-ENDLIST\n"), base)
+		assert.EqualError(t, err, "playlist has no segments")
+	})
+}
+
+func TestRewriteHlsPlaylist(t *testing.T) {
+	t.Run("should point segments and init segment to the proxy routes", func(t *testing.T) {
+		body := []byte("#EXTM3U\n#EXT-X-MAP:URI=\"https://cdn/init.mp4?sig=1\"\n\n#EXTINF:10,\nhttps://cdn/seg0.m4s?sig=2\n#EXTINF:10,\nseg1.m4s\n#EXT-X-ENDLIST\n")
+		got, err := rewriteHlsPlaylist(body)
+		assert.NoError(t, err)
+		assert.Equal(t, "#EXTM3U\n#EXT-X-MAP:URI=\"segments/init\"\n#EXTINF:10,\nsegments/0\n#EXTINF:10,\nsegments/1\n#EXT-X-ENDLIST\n", string(got))
+	})
+
+	t.Run("should fail if the body is not a playlist", func(t *testing.T) {
+		_, err := rewriteHlsPlaylist([]byte("nope"))
+		assert.EqualError(t, err, "not an m3u8 playlist")
+	})
+}
+
+func TestAppendHlsQuery(t *testing.T) {
+	t.Run("should append the signature to segments and init segment", func(t *testing.T) {
+		body := []byte("#EXTM3U\n#EXT-X-MAP:URI=\"segments/init\"\n#EXTINF:10,\nsegments/0\n#EXT-X-ENDLIST\n")
+		got := appendHlsQuery(body, "exp=1&sig=abc")
+		assert.Equal(t, "#EXTM3U\n#EXT-X-MAP:URI=\"segments/init?exp=1&sig=abc\"\n#EXTINF:10,\nsegments/0?exp=1&sig=abc\n#EXT-X-ENDLIST\n", string(got))
+	})
+}
+
+func TestHlsMediaPlaylist_SegmentUrl(t *testing.T) {
+	playlist := hlsMediaPlaylist{initSegment: "https://cdn/init", segments: []string{"https://cdn/0", "https://cdn/1"}}
+
+	t.Run("should map segment names back to upstream urls", func(t *testing.T) {
+		got, _ := playlist.segmentUrl("1")
+		assert.Equal(t, "https://cdn/1", got)
+		got, _ = playlist.segmentUrl("init")
+		assert.Equal(t, "https://cdn/init", got)
+	})
+
+	t.Run("should fail for segments outside the playlist", func(t *testing.T) {
+		_, err := playlist.segmentUrl("2")
+		assert.EqualError(t, err, "segment 2 not in playlist")
+		_, err = playlist.segmentUrl("../etc")
+		assert.EqualError(t, err, "segment ../etc not in playlist")
+		_, err = hlsMediaPlaylist{}.segmentUrl("init")
+		assert.EqualError(t, err, "playlist has no init segment")
+	})
+}
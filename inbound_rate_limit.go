@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"github.com/giorgiovilardo/etnograbber/clock"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type InboundRateLimitConfig struct {
+	TrustedProxies []string     `mapstructure:"trusted_proxies" validate:"dive,cidr"`
+	Metadata       InboundLimit `mapstructure:"metadata"`
+	Stream         InboundLimit `mapstructure:"stream"`
+}
+
+// InboundLimit describes the buckets of a group of routes, a zero
+// requests per minute disables the bucket.
+type InboundLimit struct {
+	IpRequestsPerMinute  float64 `mapstructure:"ip_requests_per_minute" validate:"gte=0"`
+	IpBurst              int     `mapstructure:"ip_burst" validate:"gte=0"`
+	KeyRequestsPerMinute float64 `mapstructure:"key_requests_per_minute" validate:"gte=0"`
+	KeyBurst             int     `mapstructure:"key_burst" validate:"gte=0"`
+}
+
+const (
+	apiKeyHeader     = "X-Api-Key"
+	apiKeyQueryParam = "api_key"
+)
+
+const (
+	InboundGroupMetadata = "metadata"
+	InboundGroupStream   = "stream"
+)
+
+const inboundBucketIdleTimeout = time.Minute * 10
+
+type inboundBucket struct {
+	limiter  *rate.Limiter
+	burst    int
+	lastSeen time.Time
+}
+
+// InboundRateLimiter keeps a token bucket per client ip and per api key for
+// every group of routes, forgetting the ones idle for a while.
+type InboundRateLimiter struct {
+	c         InboundRateLimitConfig
+	clock     clock.Clock
+	mu        sync.Mutex
+	buckets   map[string]*inboundBucket
+	lastSweep time.Time
+}
+
+func NewInboundRateLimiter(c InboundRateLimitConfig, clock clock.Clock) *InboundRateLimiter {
+	return &InboundRateLimiter{c: c, clock: clock, buckets: make(map[string]*inboundBucket), lastSweep: clock.Now()}
+}
+
+// Reload applies new limits, existing buckets adopt them on their next use.
+// Trusted proxies are read once at startup.
+func (l *InboundRateLimiter) Reload(c Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.c = c.InboundRateLimit
+}
+
+func (l *InboundRateLimiter) limit(group string) InboundLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch group {
+	case InboundGroupMetadata:
+		return l.c.Metadata
+	case InboundGroupStream:
+		return l.c.Stream
+	}
+	return InboundLimit{}
+}
+
+// Middleware limits the routes it is applied to with the limit of the group,
+// which also keeps their buckets apart from the ones of other groups.
+func (l *InboundRateLimiter) Middleware(group string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			limit := l.limit(group)
+			now := l.clock.Now()
+			var checked []*inboundBucket
+			if limit.IpRequestsPerMinute > 0 {
+				checked = append(checked, l.bucket(fmt.Sprintf("%s|ip|%s", group, c.RealIP()), limit.IpRequestsPerMinute, limit.IpBurst, now))
+			}
+			if key := rateLimitKey(c); key != "" && limit.KeyRequestsPerMinute > 0 {
+				checked = append(checked, l.bucket(fmt.Sprintf("%s|key|%s", group, key), limit.KeyRequestsPerMinute, limit.KeyBurst, now))
+			}
+			if len(checked) == 0 {
+				return next(c)
+			}
+
+			allowed := true
+			for _, b := range checked {
+				if !b.limiter.AllowN(now, 1) {
+					allowed = false
+				}
+			}
+
+			tightest := checked[0]
+			for _, b := range checked[1:] {
+				if b.limiter.TokensAt(now) < tightest.limiter.TokensAt(now) {
+					tightest = b
+				}
+			}
+			setRateLimitHeaders(c, tightest, now)
+
+			if !allowed {
+				wait := time.Duration(float64(time.Second) * (1 - tightest.limiter.TokensAt(now)) / float64(tightest.limiter.Limit()))
+				c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds())))))
+				return c.JSON(http.StatusTooManyRequests, map[string]string{"error": rateLimitExceeded})
+			}
+			return next(c)
+		}
+	}
+}
+
+func (l *InboundRateLimiter) bucket(key string, requestsPerMinute float64, burst int, now time.Time) *inboundBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, b := range l.buckets {
+			if now.Sub(b.lastSeen) > inboundBucketIdleTimeout {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	limit := rate.Limit(requestsPerMinute / 60)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &inboundBucket{limiter: rate.NewLimiter(limit, burst), burst: burst}
+		l.buckets[key] = b
+	}
+	if b.burst != burst || b.limiter.Limit() != limit {
+		b.limiter.SetLimitAt(now, limit)
+		b.limiter.SetBurstAt(now, burst)
+	}
+	b.burst = burst
+	b.lastSeen = now
+	return b
+}
+
+func setRateLimitHeaders(c echo.Context, b *inboundBucket, now time.Time) {
+	tokens := b.limiter.TokensAt(now)
+	remaining := int(math.Max(0, math.Floor(tokens)))
+	untilFull := time.Duration(float64(time.Second) * (float64(b.burst) - tokens) / float64(b.limiter.Limit()))
+	header := c.Response().Header()
+	header.Set("X-RateLimit-Limit", strconv.Itoa(b.burst))
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	header.Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(untilFull.Seconds()))))
+}
+
+// rateLimitKey prefers the name of the authenticated key, so that buckets
+// survive key rotation, falling back to the raw key when auth is disabled.
+func rateLimitKey(c echo.Context) string {
+	if name, ok := c.Get(apiKeyNameContextKey).(string); ok && name != "" {
+		return name
+	}
+	return requestApiKey(c)
+}
+
+func requestApiKey(c echo.Context) string {
+	if key := c.Request().Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	return c.QueryParam(apiKeyQueryParam)
+}
+
+// NewIpExtractor reads X-Forwarded-For only when the request comes through
+// one of the trusted proxies, otherwise the connection address is used.
+func NewIpExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range trustedProxies {
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+const rateLimitExceeded = "rate limit exceeded"
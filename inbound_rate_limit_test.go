@@ -0,0 +1,137 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInboundRateLimiter_Middleware(t *testing.T) {
+	limit := InboundLimit{IpRequestsPerMinute: 60, IpBurst: 2, KeyRequestsPerMinute: 120, KeyBurst: 3}
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	}
+	request := func(e *echo.Echo, mw echo.MiddlewareFunc, remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/1234", nil)
+		req.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		_ = mw(ok)(e.NewContext(req, rec))
+		return rec
+	}
+
+	t.Run("should let the burst through per ip and then answer 429", func(t *testing.T) {
+		e := echo.New()
+		mw := NewInboundRateLimiter(InboundRateLimitConfig{Metadata: limit}, newMockClock()).Middleware(InboundGroupMetadata)
+		first := request(e, mw, "1.1.1.1:1000", nil)
+		assert.Equal(t, http.StatusOK, first.Code)
+		assert.Equal(t, "2", first.Header().Get("X-RateLimit-Limit"))
+		assert.Equal(t, "1", first.Header().Get("X-RateLimit-Remaining"))
+		assert.Equal(t, "1", first.Header().Get("X-RateLimit-Reset"))
+		assert.Equal(t, http.StatusOK, request(e, mw, "1.1.1.1:1000", nil).Code)
+		limited := request(e, mw, "1.1.1.1:1000", nil)
+		assert.Equal(t, http.StatusTooManyRequests, limited.Code)
+		assert.Equal(t, "0", limited.Header().Get("X-RateLimit-Remaining"))
+		assert.Equal(t, "1", limited.Header().Get("Retry-After"))
+		assert.Equal(t, `{"error":"rate limit exceeded"}`, strings.Trim(limited.Body.String(), "\n"))
+		assert.Equal(t, http.StatusOK, request(e, mw, "2.2.2.2:1000", nil).Code)
+	})
+
+	t.Run("should refill the buckets over time", func(t *testing.T) {
+		e := echo.New()
+		clock := newMockClock()
+		mw := NewInboundRateLimiter(InboundRateLimitConfig{Metadata: limit}, clock).Middleware(InboundGroupMetadata)
+		request(e, mw, "1.1.1.1:1000", nil)
+		request(e, mw, "1.1.1.1:1000", nil)
+		assert.Equal(t, http.StatusTooManyRequests, request(e, mw, "1.1.1.1:1000", nil).Code)
+		clock.Sleep(time.Second)
+		assert.Equal(t, http.StatusOK, request(e, mw, "1.1.1.1:1000", nil).Code)
+	})
+
+	t.Run("should also limit per api key, across ips", func(t *testing.T) {
+		e := echo.New()
+		mw := NewInboundRateLimiter(InboundRateLimitConfig{Metadata: limit}, newMockClock()).Middleware(InboundGroupMetadata)
+		key := map[string]string{apiKeyHeader: "php"}
+		assert.Equal(t, http.StatusOK, request(e, mw, "1.1.1.1:1000", key).Code)
+		assert.Equal(t, http.StatusOK, request(e, mw, "2.2.2.2:1000", key).Code)
+		assert.Equal(t, http.StatusOK, request(e, mw, "3.3.3.3:1000", key).Code)
+		assert.Equal(t, http.StatusTooManyRequests, request(e, mw, "4.4.4.4:1000", key).Code)
+	})
+
+	t.Run("should bucket authenticated requests by key name", func(t *testing.T) {
+		e := echo.New()
+		mw := NewInboundRateLimiter(InboundRateLimitConfig{Metadata: InboundLimit{KeyRequestsPerMinute: 1, KeyBurst: 1}}, newMockClock()).Middleware(InboundGroupMetadata)
+		authenticated := func(key string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/1234", nil)
+			req.Header.Set(apiKeyHeader, key)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.Set(apiKeyNameContextKey, "php")
+			_ = mw(ok)(c)
+			return rec
+		}
+		assert.Equal(t, http.StatusOK, authenticated("old-secret").Code)
+		assert.Equal(t, http.StatusTooManyRequests, authenticated("rotated-secret").Code)
+	})
+
+	t.Run("should keep groups of routes apart", func(t *testing.T) {
+		e := echo.New()
+		limiter := NewInboundRateLimiter(InboundRateLimitConfig{Metadata: InboundLimit{IpRequestsPerMinute: 1, IpBurst: 1}, Stream: InboundLimit{IpRequestsPerMinute: 1, IpBurst: 1}}, newMockClock())
+		metadata := limiter.Middleware(InboundGroupMetadata)
+		stream := limiter.Middleware(InboundGroupStream)
+		assert.Equal(t, http.StatusOK, request(e, metadata, "1.1.1.1:1000", nil).Code)
+		assert.Equal(t, http.StatusOK, request(e, stream, "1.1.1.1:1000", nil).Code)
+		assert.Equal(t, http.StatusTooManyRequests, request(e, stream, "1.1.1.1:1000", nil).Code)
+	})
+
+	t.Run("should apply new limits on reload", func(t *testing.T) {
+		e := echo.New()
+		limiter := NewInboundRateLimiter(InboundRateLimitConfig{Metadata: InboundLimit{IpRequestsPerMinute: 1, IpBurst: 1}}, newMockClock())
+		mw := limiter.Middleware(InboundGroupMetadata)
+		request(e, mw, "1.1.1.1:1000", nil)
+		assert.Equal(t, http.StatusTooManyRequests, request(e, mw, "1.1.1.1:1000", nil).Code)
+		limiter.Reload(Config{InboundRateLimit: InboundRateLimitConfig{}})
+		assert.Equal(t, http.StatusOK, request(e, mw, "1.1.1.1:1000", nil).Code)
+	})
+
+	t.Run("should not limit when disabled", func(t *testing.T) {
+		e := echo.New()
+		mw := NewInboundRateLimiter(InboundRateLimitConfig{}, newMockClock()).Middleware(InboundGroupMetadata)
+		for i := 0; i < 10; i++ {
+			rec := request(e, mw, "1.1.1.1:1000", nil)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Empty(t, rec.Header().Get("X-RateLimit-Limit"))
+		}
+	})
+
+	t.Run("should only trust x-forwarded-for from trusted proxies", func(t *testing.T) {
+		e := echo.New()
+		e.IPExtractor, _ = NewIpExtractor([]string{"10.0.0.0/8"})
+		mw := NewInboundRateLimiter(InboundRateLimitConfig{Metadata: InboundLimit{IpRequestsPerMinute: 1, IpBurst: 1}}, newMockClock()).Middleware(InboundGroupMetadata)
+		assert.Equal(t, http.StatusOK, request(e, mw, "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "1.1.1.1"}).Code)
+		assert.Equal(t, http.StatusOK, request(e, mw, "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "2.2.2.2"}).Code)
+		assert.Equal(t, http.StatusOK, request(e, mw, "5.5.5.5:1000", map[string]string{"X-Forwarded-For": "3.3.3.3"}).Code)
+		assert.Equal(t, http.StatusTooManyRequests, request(e, mw, "5.5.5.5:1000", map[string]string{"X-Forwarded-For": "4.4.4.4"}).Code)
+	})
+}
+
+func TestNewIpExtractor(t *testing.T) {
+	t.Run("should ignore x-forwarded-for without trusted proxies", func(t *testing.T) {
+		extractor, _ := NewIpExtractor(nil)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		req.Header.Set("X-Forwarded-For", "1.1.1.1")
+		assert.Equal(t, "10.0.0.1", extractor(req))
+	})
+
+	t.Run("should fail on invalid cidrs", func(t *testing.T) {
+		_, err := NewIpExtractor([]string{"nope"})
+		assert.Error(t, err)
+	})
+}
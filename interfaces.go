@@ -1,22 +1,118 @@
 package main
 
+import (
+	"net/http"
+	"time"
+)
+
 type SoundcloudApi interface {
 	Auth() ([]byte, error)
 	Renew(t Token) ([]byte, error)
 }
 
+type CredentialApi interface {
+	ForCredential(c Credential) SoundcloudApi
+}
+
+type CredentialObserver interface {
+	ObserveResponse(req *http.Request, res *http.Response) (rateLimitHandled bool)
+}
+
 type TokenRepository interface {
 	GetToken() (Token, error)
 }
 
+// TokenPeeker shows the token a repository holds without getting one, the
+// zero Token when it holds none.
+type TokenPeeker interface {
+	PeekToken() Token
+}
+
+type PeekableTokenRepository interface {
+	TokenRepository
+	TokenPeeker
+}
+
+// CredentialTokenRepository is the token repository of a single credential,
+// whose token can be dropped when SoundCloud rejects it.
+type CredentialTokenRepository interface {
+	TokenRepository
+	TokenPeeker
+	Invalidate()
+}
+
+// TokenStore shares tokens between replicas. Tokens are stored by key, one
+// per credential, and only the holder of a key's lease may renew its token.
+type TokenStore interface {
+	// Load finds no token when the stored one was rejected.
+	Load(key string) (Token, bool, error)
+	Save(key string, t Token) error
+	// Reject marks the token with accessToken as refused by SoundCloud, so
+	// the leader replaces it even if it is not about to expire.
+	Reject(key, accessToken string) error
+	// TryLead acquires or extends the lease on key for holder.
+	TryLead(key, holder string, ttl time.Duration) (bool, error)
+	Release(key, holder string) error
+}
+
 type TrackCache interface {
-	Add(key int, value []byte) (evicted bool)
-	Contains(key int) bool
-	Get(key int) (value []byte, ok bool)
+	Add(key TrackKey, value Track) (evicted bool)
+	Contains(key TrackKey) bool
+	Get(key TrackKey) (value Track, ok bool)
+	// GetOrLoad returns the cached track or the one load returns, caching it.
+	// Concurrent misses on a key share a single load.
+	GetOrLoad(key TrackKey, load func() (Track, error)) (Track, error)
+	Remove(key TrackKey) (present bool)
+	Keys() []TrackKey
+	Stats() CacheStats
+	// OnEvict registers f to be called with every track evicted to make room.
+	OnEvict(f func(key TrackKey, value Track))
+}
+
+type TrackDataCache interface {
+	Add(key int, value map[string]interface{})
+	Get(key int) (value map[string]interface{}, ok bool)
+}
+
+type SegmentCache interface {
+	Add(key string, value Track) (evicted bool)
+	Get(key string) (value Track, ok bool)
+}
+
+type PlaylistCache interface {
+	Add(key int, value HlsPlaylist) (evicted bool)
+	Get(key int) (value HlsPlaylist, ok bool)
+	Remove(key int) (present bool)
+}
+
+type Transcoder interface {
+	Transcode(in Track, r Rendition) (Track, error)
+}
+
+type TrackValidator interface {
+	Validate(id int, t Track) error
 }
 
 type TrackRepository interface {
-	GetTrack(t Token, id int) ([]byte, error)
+	GetTrack(t Token, id int) (Track, error)
+}
+
+type TrackUrlRepository interface {
+	GetTrackUrl(t Token, id int) (string, error)
+}
+
+type HlsRepository interface {
+	GetHlsPlaylist(t Token, id int) (HlsPlaylist, error)
+	GetHlsSegment(t Token, segmentUrl string) ([]byte, error)
+}
+
+type WaveformRepository interface {
+	GetWaveform(t Token, waveformUrl string) (Waveform, error)
+}
+
+type WaveformCache interface {
+	Add(key int, value Waveform) (evicted bool)
+	Get(key int) (value Waveform, ok bool)
 }
 
 type TrackDataRepository interface {
@@ -28,5 +124,22 @@ type TrackDataService interface {
 }
 
 type TrackService interface {
-	GetTrack(id int) ([]byte, error)
+	GetTrack(id int) (Track, error)
+}
+
+type WaveformService interface {
+	GetWaveform(id int, samples int) (Waveform, error)
+}
+
+type TranscodedTrackService interface {
+	GetRendition(id int, r Rendition) (Track, error)
+}
+
+type TrackUrlService interface {
+	GetTrackUrl(id int) (string, error)
+}
+
+type HlsService interface {
+	GetPlaylist(id int) ([]byte, error)
+	GetSegment(id int, segment string) (Track, error)
 }
@@ -0,0 +1,41 @@
+package main
+
+import "sync"
+
+// loadGroup coalesces concurrent loads of the same key: the first caller
+// loads, the others wait for it and share what it got, error included. The
+// zero value is ready to use.
+type loadGroup[K comparable, V any] struct {
+	mu    sync.Mutex
+	calls map[K]*loadCall[V]
+}
+
+type loadCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+func (g *loadGroup[K, V]) Do(key K, load func() (V, error)) (V, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[K]*loadCall[V])
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &loadCall[V]{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.value, call.err = load()
+	return call.value, call.err
+}
@@ -1,26 +1,149 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	clockLib "github.com/giorgiovilardo/etnograbber/clock"
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/spf13/viper"
+	"log"
 	"net/http"
 )
 
 func main() {
-	config := GetConfig()
+	configPath := flag.String("config", "", "path to the config file (default config.toml, if present)")
+	flag.Parse()
+	config := GetConfig(*configPath)
 	clock := clockLib.NewRealClock()
-	httpSoundcloudApi := NewHttpSoundcloudApi(config)
-	httpTokenRepository := NewHttpTokenRepository(clock, httpSoundcloudApi)
-	httpTrackDataService := NewHttpTrackDataService(httpTokenRepository, httpSoundcloudApi)
-	trackCache, _ := lru.New[int, []byte](config.CacheSize)
-	httpCachedTrackService := NewHttpCachedTrackService(trackCache, httpTokenRepository, httpSoundcloudApi)
+	httpSoundcloudApi := NewHttpSoundcloudApi(config, clock)
+	var stoppables []Stoppable
+	tokens := CredentialTokens(httpSoundcloudApi, clock)
+	tokenStore, err := NewTokenStore(config.TokenStore)
+	if err != nil {
+		log.Fatalf("token store: %v", err)
+	}
+	if tokenStore != nil {
+		tokens = func(c Credential) CredentialTokenRepository {
+			r := NewSharedTokenRepository(tokenStore, c.Name, httpSoundcloudApi.ForCredential(c), clock, config.TokenStore)
+			r.Start()
+			stoppables = append(stoppables, r)
+			return r
+		}
+	}
+	credentialPool := NewCredentialPool(config.Credentials(), tokens, clock, config.CredentialCooldown)
+	httpSoundcloudApi.SetCredentialObserver(credentialPool)
+	memoryTrackCache, _ := NewMemoryTrackCache(config.CacheSize)
+	memoryTrackDataCache, _ := NewMemoryTrackDataCache(config.MetadataCacheSize, config.MetadataCacheTtl, clock)
+	var trackCache TrackCache = memoryTrackCache
+	var trackDataCache TrackDataCache = memoryTrackDataCache
+	if config.RedisCache.Url != "" {
+		redisClient, err := NewRedisClient(config.RedisCache.Url)
+		if err != nil {
+			log.Fatalf("redis cache: %v", err)
+		}
+		trackCache = NewRedisTrackCache(redisClient, config.RedisCache, memoryTrackCache, clock)
+		trackDataCache = NewRedisTrackDataCache(redisClient, config.RedisCache, config.MetadataCacheTtl, memoryTrackDataCache, clock)
+	}
+	httpTrackDataService := NewHttpTrackDataService(trackDataCache, credentialPool, httpSoundcloudApi)
+	httpCachedTrackService := NewHttpCachedTrackService(trackCache, credentialPool, httpSoundcloudApi, NewContentValidator(config.ContentValidation))
+	playlistCache, _ := lru.New[int, HlsPlaylist](config.HlsCacheSize)
+	segmentCache, _ := lru.New[string, Track](config.HlsCacheSize)
+	httpHlsService := NewHttpHlsService(playlistCache, segmentCache, credentialPool, httpSoundcloudApi)
+	inboundRateLimiter := NewInboundRateLimiter(config.InboundRateLimit, clock)
+	metadataRateLimit := inboundRateLimiter.Middleware(InboundGroupMetadata)
+	streamRateLimit := inboundRateLimiter.Middleware(InboundGroupStream)
+	allowedOrigins := NewAllowedOrigins(config.AllowedOrigins)
+	apiKeys := NewApiKeys(config.ApiKeys)
+	streamSigner := NewStreamSigner(config.StreamSigning, clock)
+	WatchConfig(viper.GetViper(), httpSoundcloudApi, inboundRateLimiter, allowedOrigins, apiKeys, streamSigner, ReloadFunc(func(c Config) {
+		memoryTrackCache.Resize(c.CacheSize)
+		memoryTrackDataCache.Resize(c.MetadataCacheSize)
+		playlistCache.Resize(c.HlsCacheSize)
+		segmentCache.Resize(c.HlsCacheSize)
+	}))
 	e := echo.New()
 	e.HideBanner = true
-	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{AllowOrigins: config.AllowedOrigins, AllowMethods: []string{http.MethodGet}}))
+	ipExtractor, err := NewIpExtractor(config.InboundRateLimit.TrustedProxies)
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	e.IPExtractor = ipExtractor
+	e.Use(RequestLogger())
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{AllowOriginFunc: allowedOrigins.Allow, AllowMethods: []string{http.MethodGet}}))
+	signedRoutes := streamRoutes(config.Waveform.Source)
+	ownAuth := func(c echo.Context) bool {
+		return (config.StreamSigning.Secret != "" && isSignedStreamRequest(c, signedRoutes)) || isTokenExportRequest(c)
+	}
+	if len(config.ApiKeys) > 0 {
+		e.Use(ApiKeyAuth(apiKeys, clock, ownAuth))
+	}
 	e.GET("/health", HealthHandler)
-	e.GET("/:trackId", TrackDataHandler(httpTrackDataService))
-	e.GET("/:trackId/stream", TrackHandler(httpCachedTrackService))
-	e.Logger.Fatal(e.Start(config.Address))
+	e.GET("/health/live", HealthHandler)
+	readinessChecks := map[string]ReadinessCheck{
+		"token":    TokenCheck(credentialPool, clock),
+		"upstream": UpstreamCheck(httpSoundcloudApi.Breaker(), httpSoundcloudApi.Limiter()),
+		"cache":    CacheCheck(trackCache),
+	}
+	if p, ok := tokenStore.(Pinger); ok {
+		readinessChecks["token_store"] = p.Ping
+	}
+	e.GET("/health/ready", ReadyHandler(readinessChecks))
+	if config.TokenExport.Key != "" {
+		e.GET(tokenExportPath, TokenExportHandler(credentialPool, clock), TokenExportAuth(config.TokenExport.Key))
+	}
+	e.GET("/:trackId", TrackDataHandler(httpTrackDataService), metadataRateLimit)
+	streamMiddlewares := []echo.MiddlewareFunc{streamRateLimit}
+	if config.StreamSigning.Secret != "" {
+		streamMiddlewares = append(streamMiddlewares, streamSigner.Middleware())
+		if len(config.ApiKeys) > 0 {
+			e.GET("/sign/:trackId", SignHandler(streamSigner))
+		}
+	}
+	streamHandler := TrackHandler(httpCachedTrackService)
+	if config.RedirectStreams {
+		streamHandler = TrackRedirectHandler(NewHttpTrackUrlService(credentialPool, httpSoundcloudApi))
+	}
+	if config.Transcoding.FfmpegPath != "" {
+		transcodedTrackService := NewHttpTranscodedTrackService(trackCache, httpCachedTrackService, NewFfmpegTranscoder(config.Transcoding))
+		streamHandler = TranscodeHandler(transcodedTrackService, config.Transcoding, streamHandler)
+	}
+	e.GET("/:trackId/stream", streamHandler, streamMiddlewares...)
+	waveformCache, _ := lru.New[int, Waveform](config.Waveform.CacheSize)
+	waveformService := NewHttpWaveformService(waveformCache, config.Waveform.Source, credentialPool, httpTrackDataService, httpSoundcloudApi, httpCachedTrackService)
+	waveformMiddlewares := []echo.MiddlewareFunc{metadataRateLimit}
+	if signedRoutes["/:trackId/waveform"] {
+		waveformMiddlewares = streamMiddlewares
+	}
+	e.GET("/:trackId/waveform", WaveformHandler(waveformService, config.Waveform), waveformMiddlewares...)
+	e.GET("/:trackId/hls/playlist.m3u8", HlsPlaylistHandler(httpHlsService), streamMiddlewares...)
+	e.GET("/:trackId/hls/segments/:segment", HlsSegmentHandler(httpHlsService), streamMiddlewares...)
+	start := func() error {
+		return e.Start(config.Address)
+	}
+	if config.Tls.Enabled() {
+		tlsConfig, acmeChallenges, err := NewServerTls(config.Tls, clock)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		e.TLSServer.Addr = config.Address
+		e.TLSServer.TLSConfig = tlsConfig
+		start = func() error {
+			return e.StartServer(e.TLSServer)
+		}
+		if config.Tls.RedirectAddress != "" {
+			redirect := NewRedirectServer(config.Tls.RedirectAddress, acmeChallenges(HttpsRedirect(config.Address)))
+			go func() {
+				if err := redirect.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+					e.Logger.Fatal(err)
+				}
+			}()
+			stoppables = append(stoppables, StopFunc(redirect.Shutdown))
+		}
+	}
+	err = Serve(e, start, config.ShutdownTimeout, stoppables...)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		e.Logger.Fatal(err)
+	}
 }
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/giorgiovilardo/etnograbber/clock"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RedisCacheConfig struct {
+	Url        string        `mapstructure:"url"`
+	Prefix     string        `mapstructure:"prefix"`
+	TrackTtl   time.Duration `mapstructure:"track_ttl" validate:"gte=0"`
+	ChunkSize  int           `mapstructure:"chunk_size" validate:"gt=0"`
+	RetryAfter time.Duration `mapstructure:"retry_after" validate:"gt=0"`
+}
+
+// redisFallback tracks whether redis is usable. After a failure the caches
+// serve from memory for retryAfter instead of waiting on redis every time.
+type redisFallback struct {
+	clock      clock.Clock
+	retryAfter time.Duration
+	mu         sync.Mutex
+	downUntil  time.Time
+}
+
+func newRedisFallback(clock clock.Clock, retryAfter time.Duration) *redisFallback {
+	return &redisFallback{clock: clock, retryAfter: retryAfter}
+}
+
+func (f *redisFallback) available() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.downUntil.After(f.clock.Now())
+}
+
+func (f *redisFallback) failed(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.downUntil.After(f.clock.Now()) {
+		return
+	}
+	f.downUntil = f.clock.Now().Add(f.retryAfter)
+	log.Printf("redis cache unavailable, using memory for %s: %v", f.retryAfter, err)
+}
+
+// RedisTrackCache shares tracks between instances. A track is split in
+// chunkSize values next to a header naming them, so large MP3s never hit the
+// redis value limits, and expires after ttl. While redis is down tracks go
+// to memory. Redis expires tracks on its own, only evictions from memory are
+// counted and reported to OnEvict.
+type RedisTrackCache struct {
+	client    *redis.Client
+	prefix    string
+	ttl       time.Duration
+	chunkSize int
+	memory    TrackCache
+	fallback  *redisFallback
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	loads     loadGroup[TrackKey, Track]
+}
+
+type redisTrackHeader struct {
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	Chunks      int    `json:"chunks"`
+}
+
+func NewRedisTrackCache(client *redis.Client, c RedisCacheConfig, memory TrackCache, clock clock.Clock) *RedisTrackCache {
+	return &RedisTrackCache{
+		client:    client,
+		prefix:    c.Prefix + "track:",
+		ttl:       c.TrackTtl,
+		chunkSize: c.ChunkSize,
+		memory:    memory,
+		fallback:  newRedisFallback(clock, c.RetryAfter),
+	}
+}
+
+func (r *RedisTrackCache) Add(key TrackKey, value Track) (evicted bool) {
+	if !r.fallback.available() {
+		return r.memory.Add(key, value)
+	}
+	if err := r.add(key, value); err != nil {
+		r.fallback.failed(err)
+		return r.memory.Add(key, value)
+	}
+	return false
+}
+
+func (r *RedisTrackCache) Contains(key TrackKey) bool {
+	if !r.fallback.available() {
+		return r.memory.Contains(key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	n, err := r.client.Exists(ctx, r.key(key)).Result()
+	if err != nil {
+		r.fallback.failed(err)
+		return r.memory.Contains(key)
+	}
+	return n == 1 || r.memory.Contains(key)
+}
+
+func (r *RedisTrackCache) Get(key TrackKey) (Track, bool) {
+	track, ok := r.lookup(key)
+	if ok {
+		r.hits.Add(1)
+	} else {
+		r.misses.Add(1)
+	}
+	return track, ok
+}
+
+// GetOrLoad coalesces the loads of this instance only, another instance
+// missing the same track loads it too. Like the memory cache it looks the
+// key up again once leading the load.
+func (r *RedisTrackCache) GetOrLoad(key TrackKey, load func() (Track, error)) (Track, error) {
+	if track, ok := r.Get(key); ok {
+		return track, nil
+	}
+	return r.loads.Do(key, func() (Track, error) {
+		if track, ok := r.lookup(key); ok {
+			return track, nil
+		}
+		track, err := load()
+		if err == nil {
+			r.Add(key, track)
+		}
+		return track, err
+	})
+}
+
+func (r *RedisTrackCache) lookup(key TrackKey) (Track, bool) {
+	if !r.fallback.available() {
+		return r.memory.Get(key)
+	}
+	track, ok, err := r.get(key)
+	if err != nil {
+		r.fallback.failed(err)
+		return r.memory.Get(key)
+	}
+	if !ok {
+		// added while redis was down
+		return r.memory.Get(key)
+	}
+	return track, true
+}
+
+func (r *RedisTrackCache) Remove(key TrackKey) bool {
+	present := r.memory.Remove(key)
+	if !r.fallback.available() {
+		return present
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	header, err := r.header(ctx, key)
+	if err != nil {
+		r.fallback.failed(err)
+		return present
+	}
+	if header == nil {
+		return present
+	}
+	keys := []string{r.key(key)}
+	for i := 0; i < header.Chunks; i++ {
+		keys = append(keys, r.chunkKey(key, i))
+	}
+	if err := r.client.Del(ctx, keys...).Err(); err != nil {
+		r.fallback.failed(err)
+	}
+	return true
+}
+
+// Keys lists the tracks in redis and in memory.
+func (r *RedisTrackCache) Keys() []TrackKey {
+	keys := r.memory.Keys()
+	if !r.fallback.available() {
+		return keys
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	stored, err := r.scan(ctx)
+	if err != nil {
+		r.fallback.failed(err)
+		return keys
+	}
+	seen := make(map[TrackKey]bool, len(keys))
+	for _, key := range keys {
+		seen[key] = true
+	}
+	for key := range stored {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Stats counts entries and bytes in redis scanning the track headers, which
+// is meant for metrics and admin pages, not for every request.
+func (r *RedisTrackCache) Stats() CacheStats {
+	stats := r.memory.Stats()
+	stats.Hits = r.hits.Load()
+	stats.Misses = r.misses.Load()
+	if !r.fallback.available() {
+		return stats
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	stored, err := r.scan(ctx)
+	if err != nil {
+		r.fallback.failed(err)
+		return stats
+	}
+	for _, size := range stored {
+		stats.Entries++
+		stats.Bytes += int64(size)
+	}
+	return stats
+}
+
+func (r *RedisTrackCache) OnEvict(f func(key TrackKey, value Track)) {
+	r.memory.OnEvict(f)
+}
+
+// Ping reports whether redis answers, for the readiness check.
+func (r *RedisTrackCache) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return r.client.Ping(ctx).Err()
+}
+
+// scan returns the size of every track stored in redis.
+func (r *RedisTrackCache) scan(ctx context.Context) (map[TrackKey]int, error) {
+	var keys []string
+	iter := r.client.Scan(ctx, 0, r.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		if !strings.Contains(strings.TrimPrefix(iter.Val(), r.prefix), ":") {
+			keys = append(keys, iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	headers, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[TrackKey]int, len(keys))
+	for i, data := range headers {
+		s, ok := data.(string)
+		if !ok {
+			continue
+		}
+		var header redisTrackHeader
+		key, err := parseTrackKey(strings.TrimPrefix(keys[i], r.prefix))
+		if err != nil || json.Unmarshal([]byte(s), &header) != nil {
+			continue
+		}
+		sizes[key] = header.Size
+	}
+	return sizes, nil
+}
+
+func (r *RedisTrackCache) header(ctx context.Context, key TrackKey) (*redisTrackHeader, error) {
+	data, err := r.client.Get(ctx, r.key(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var header redisTrackHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+func (r *RedisTrackCache) add(key TrackKey, value Track) error {
+	chunks := (len(value.Data) + r.chunkSize - 1) / r.chunkSize
+	header, err := json.Marshal(redisTrackHeader{ContentType: value.ContentType, Size: len(value.Data), Chunks: chunks})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	_, err = r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for i := 0; i < chunks; i++ {
+			end := (i + 1) * r.chunkSize
+			if end > len(value.Data) {
+				end = len(value.Data)
+			}
+			p.Set(ctx, r.chunkKey(key, i), value.Data[i*r.chunkSize:end], r.ttl)
+		}
+		p.Set(ctx, r.key(key), header, r.ttl)
+		return nil
+	})
+	return err
+}
+
+// get reads the header and then the chunks; a chunk gone meanwhile, expired
+// or evicted by redis, counts as a miss.
+func (r *RedisTrackCache) get(key TrackKey) (Track, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	header, err := r.header(ctx, key)
+	if err != nil || header == nil {
+		return Track{}, false, err
+	}
+	if header.Chunks == 0 {
+		return Track{Data: []byte{}, ContentType: header.ContentType}, true, nil
+	}
+
+	keys := make([]string, header.Chunks)
+	for i := range keys {
+		keys[i] = r.chunkKey(key, i)
+	}
+	chunks, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return Track{}, false, err
+	}
+	track := Track{Data: make([]byte, 0, header.Size), ContentType: header.ContentType}
+	for _, chunk := range chunks {
+		s, ok := chunk.(string)
+		if !ok {
+			return Track{}, false, nil
+		}
+		track.Data = append(track.Data, s...)
+	}
+	if len(track.Data) != header.Size {
+		return Track{}, false, nil
+	}
+	return track, true, nil
+}
+
+func (r *RedisTrackCache) key(key TrackKey) string {
+	return r.prefix + key.String()
+}
+
+func (r *RedisTrackCache) chunkKey(key TrackKey, chunk int) string {
+	return fmt.Sprintf("%s%s:%d", r.prefix, key, chunk)
+}
+
+// RedisTrackDataCache shares track metadata between instances for ttl,
+// falling back to memory while redis is down.
+type RedisTrackDataCache struct {
+	client   *redis.Client
+	prefix   string
+	ttl      time.Duration
+	memory   TrackDataCache
+	fallback *redisFallback
+}
+
+func NewRedisTrackDataCache(client *redis.Client, c RedisCacheConfig, ttl time.Duration, memory TrackDataCache, clock clock.Clock) *RedisTrackDataCache {
+	return &RedisTrackDataCache{
+		client:   client,
+		prefix:   c.Prefix + "metadata:",
+		ttl:      ttl,
+		memory:   memory,
+		fallback: newRedisFallback(clock, c.RetryAfter),
+	}
+}
+
+func (r *RedisTrackDataCache) Add(key int, value map[string]interface{}) {
+	if !r.fallback.available() {
+		r.memory.Add(key, value)
+		return
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := r.client.Set(ctx, r.prefix+strconv.Itoa(key), data, r.ttl).Err(); err != nil {
+		r.fallback.failed(err)
+		r.memory.Add(key, value)
+	}
+}
+
+func (r *RedisTrackDataCache) Get(key int) (map[string]interface{}, bool) {
+	if !r.fallback.available() {
+		return r.memory.Get(key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	data, err := r.client.Get(ctx, r.prefix+strconv.Itoa(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return r.memory.Get(key)
+	}
+	if err != nil {
+		r.fallback.failed(err)
+		return r.memory.Get(key)
+	}
+	var value map[string]interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, false
+	}
+	return value, true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var testRedisCacheConfig = RedisCacheConfig{Prefix: "etnograbber:cache:", TrackTtl: time.Hour, ChunkSize: 4, RetryAfter: time.Second * 10}
+
+func TestRedisTrackCache(t *testing.T) {
+	newCache := func(t *testing.T) (*RedisTrackCache, *MemoryTrackCache, *miniredis.Miniredis, *mockClock) {
+		mr := miniredis.RunT(t)
+		client, _ := NewRedisClient("redis://" + mr.Addr())
+		memory, _ := NewMemoryTrackCache(10)
+		clock := newMockClock()
+		return NewRedisTrackCache(client, testRedisCacheConfig, memory, clock), memory, mr, clock
+	}
+
+	t.Run("should store tracks in chunks", func(t *testing.T) {
+		cache, memory, mr, _ := newCache(t)
+		track := Track{Data: []byte("0123456789"), ContentType: "audio/mpeg"}
+		cache.Add(TrackKey{Id: 1}, track)
+		assert.True(t, cache.Contains(TrackKey{Id: 1}))
+		got, ok := cache.Get(TrackKey{Id: 1})
+		assert.True(t, ok)
+		assert.Equal(t, track, got)
+		assert.Equal(t, "89", mustGet(t, mr, "etnograbber:cache:track:1:2"))
+		assert.Equal(t, 0, memory.Stats().Entries)
+	})
+
+	t.Run("should keep large tracks", func(t *testing.T) {
+		cache, _, _, _ := newCache(t)
+		cache.chunkSize = 512 * 1024
+		track := Track{Data: bytes.Repeat([]byte{0xff}, 3*1024*1024+7), ContentType: "audio/mpeg"}
+		cache.Add(TrackKey{Id: 1}, track)
+		got, ok := cache.Get(TrackKey{Id: 1})
+		assert.True(t, ok)
+		assert.Equal(t, track, got)
+	})
+
+	t.Run("should forget tracks after the ttl", func(t *testing.T) {
+		cache, _, mr, _ := newCache(t)
+		cache.Add(TrackKey{Id: 1}, Track{Data: []byte("0123456789"), ContentType: "audio/mpeg"})
+		mr.FastForward(time.Hour)
+		assert.False(t, cache.Contains(TrackKey{Id: 1}))
+		_, ok := cache.Get(TrackKey{Id: 1})
+		assert.False(t, ok)
+	})
+
+	t.Run("should miss when a chunk is gone", func(t *testing.T) {
+		cache, _, mr, _ := newCache(t)
+		cache.Add(TrackKey{Id: 1}, Track{Data: []byte("0123456789"), ContentType: "audio/mpeg"})
+		mr.Del("etnograbber:cache:track:1:1")
+		_, ok := cache.Get(TrackKey{Id: 1})
+		assert.False(t, ok)
+	})
+
+	t.Run("should remove a track with its chunks", func(t *testing.T) {
+		cache, _, mr, _ := newCache(t)
+		cache.Add(TrackKey{Id: 1}, Track{Data: []byte("0123456789"), ContentType: "audio/mpeg"})
+		assert.True(t, cache.Remove(TrackKey{Id: 1}))
+		assert.False(t, cache.Remove(TrackKey{Id: 1}))
+		assert.Empty(t, mr.Keys())
+	})
+
+	t.Run("should count tracks in redis and lookups", func(t *testing.T) {
+		cache, _, _, _ := newCache(t)
+		cache.Add(TrackKey{Id: 1}, Track{Data: []byte("0123456789"), ContentType: "audio/mpeg"})
+		cache.Add(TrackKey{Id: 2}, Track{Data: []byte("01234"), ContentType: "audio/mpeg"})
+		cache.Get(TrackKey{Id: 1})
+		cache.Get(TrackKey{Id: 3})
+		assert.ElementsMatch(t, []TrackKey{{Id: 1}, {Id: 2}}, cache.Keys())
+		assert.Equal(t, CacheStats{Hits: 1, Misses: 1, Bytes: 15, Entries: 2}, cache.Stats())
+	})
+
+	t.Run("should ping redis", func(t *testing.T) {
+		cache, _, mr, _ := newCache(t)
+		assert.NoError(t, CacheCheck(cache)())
+		mr.Close()
+		assert.Error(t, CacheCheck(cache)())
+	})
+
+	t.Run("should use memory while redis is down", func(t *testing.T) {
+		cache, memory, mr, clock := newCache(t)
+		track := Track{Data: []byte("0123456789"), ContentType: "audio/mpeg"}
+		mr.Close()
+		cache.Add(TrackKey{Id: 1}, track)
+		assert.Equal(t, 1, memory.Stats().Entries)
+		got, ok := cache.Get(TrackKey{Id: 1})
+		assert.True(t, ok)
+		assert.Equal(t, track, got)
+		assert.False(t, cache.fallback.available())
+		clock.Sleep(time.Second * 10)
+		assert.True(t, cache.fallback.available())
+	})
+}
+
+func TestRedisTrackDataCache(t *testing.T) {
+	newCache := func(t *testing.T) (*RedisTrackDataCache, *miniredis.Miniredis) {
+		mr := miniredis.RunT(t)
+		client, _ := NewRedisClient("redis://" + mr.Addr())
+		return NewRedisTrackDataCache(client, testRedisCacheConfig, time.Minute*10, newMemoryTrackDataCacheForTest(), newMockClock()), mr
+	}
+
+	t.Run("should keep track data until the ttl expires", func(t *testing.T) {
+		cache, mr := newCache(t)
+		cache.Add(1, map[string]interface{}{"title": "miao"})
+		got, ok := cache.Get(1)
+		assert.True(t, ok)
+		assert.Equal(t, "miao", got["title"])
+		mr.FastForward(time.Minute * 10)
+		_, ok = cache.Get(1)
+		assert.False(t, ok)
+	})
+
+	t.Run("should use memory while redis is down", func(t *testing.T) {
+		cache, mr := newCache(t)
+		mr.Close()
+		cache.Add(1, map[string]interface{}{"title": "miao"})
+		got, ok := cache.Get(1)
+		assert.True(t, ok)
+		assert.Equal(t, "miao", got["title"])
+	})
+}
+
+func mustGet(t *testing.T, mr *miniredis.Miniredis, key string) string {
+	value, err := mr.Get(key)
+	assert.NoError(t, err)
+	return value
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"log"
+)
+
+// Reloadable is implemented by whatever can apply a new Config while
+// running. Implementations pick the settings they can swap safely and
+// ignore the rest, which still needs a restart.
+type Reloadable interface {
+	Reload(c Config)
+}
+
+type ReloadFunc func(c Config)
+
+func (f ReloadFunc) Reload(c Config) {
+	f(c)
+}
+
+// WatchConfig reloads the config file every time it changes on disk, it does
+// nothing when the config comes from the environment alone.
+func WatchConfig(v *viper.Viper, reloadables ...Reloadable) {
+	if v.ConfigFileUsed() == "" {
+		return
+	}
+	v.OnConfigChange(func(_ fsnotify.Event) {
+		_ = reloadConfig(v, reloadables)
+	})
+	v.WatchConfig()
+}
+
+// reloadConfig validates the config v holds, its secrets resolved again, and
+// hands it to the reloadables; an invalid config or an unreadable secret is
+// logged and the running config is kept.
+func reloadConfig(v *viper.Viper, reloadables []Reloadable) error {
+	c, err := loadConfig(v)
+	if err != nil {
+		log.Printf("config reload rejected, keeping the running config: %v", err)
+		return err
+	}
+	for _, r := range reloadables {
+		r.Reload(c)
+	}
+	log.Printf("config reloaded")
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type RetryConfig struct {
+	MaxAttempts int           `mapstructure:"max_attempts" validate:"gte=0"`
+	BaseDelay   time.Duration `mapstructure:"base_delay" validate:"gte=0"`
+	MaxDelay    time.Duration `mapstructure:"max_delay" validate:"gte=0"`
+	Jitter      float64       `mapstructure:"jitter" validate:"gte=0,lte=1"`
+}
+
+type retryPolicy struct {
+	c      RetryConfig
+	random func() float64
+}
+
+func newRetryPolicy(c RetryConfig) retryPolicy {
+	return retryPolicy{c: c, random: rand.Float64}
+}
+
+func (p retryPolicy) attempts() int {
+	if p.c.MaxAttempts < 1 {
+		return 1
+	}
+	return p.c.MaxAttempts
+}
+
+// backoff is the exponential delay before the given retry (1 being the
+// first), capped at MaxDelay and shortened by up to Jitter of itself.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	delay := float64(p.c.BaseDelay) * math.Pow(2, float64(retry-1))
+	if p.c.MaxDelay > 0 && delay > float64(p.c.MaxDelay) {
+		delay = float64(p.c.MaxDelay)
+	}
+	return time.Duration(delay * (1 - p.c.Jitter*p.random()))
+}
+
+// delay decides how long to wait before retrying, honouring Retry-After.
+// It reports false when upstream asks to wait longer than MaxDelay, since
+// holding the listener that long is worse than failing.
+func (p retryPolicy) delay(retry int, res *http.Response, now time.Time) (time.Duration, bool) {
+	if res != nil {
+		if wait, ok := retryAfter(res, now); ok {
+			if p.c.MaxDelay > 0 && wait > p.c.MaxDelay {
+				return 0, false
+			}
+			return wait, true
+		}
+	}
+	return p.backoff(retry), true
+}
+
+// isRetryable accepts connect errors and 429 responses for any request, as
+// upstream never handled them, other transport errors and 5xx responses only
+// for idempotent ones: a token POST may have gone through and used up its
+// refresh token.
+func isRetryable(req *http.Request, res *http.Response, err error) bool {
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		var netErr net.Error
+		return errors.As(err, &netErr) && isIdempotent(req.Method)
+	}
+	if res.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return res.StatusCode >= http.StatusInternalServerError && isIdempotent(req.Method)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+func retryAfter(res *http.Response, now time.Time) (time.Duration, bool) {
+	header := res.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
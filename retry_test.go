@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	t.Run("should double the delay on every retry up to max delay", func(t *testing.T) {
+		p := newRetryPolicy(RetryConfig{BaseDelay: time.Millisecond * 100, MaxDelay: time.Millisecond * 500})
+		assert.Equal(t, time.Millisecond*100, p.backoff(1))
+		assert.Equal(t, time.Millisecond*200, p.backoff(2))
+		assert.Equal(t, time.Millisecond*400, p.backoff(3))
+		assert.Equal(t, time.Millisecond*500, p.backoff(4))
+	})
+
+	t.Run("should shave off up to jitter of the delay", func(t *testing.T) {
+		p := newRetryPolicy(RetryConfig{BaseDelay: time.Second, Jitter: 0.5})
+		p.random = func() float64 { return 1 }
+		assert.Equal(t, time.Millisecond*500, p.backoff(1))
+		p.random = func() float64 { return 0 }
+		assert.Equal(t, time.Second, p.backoff(1))
+	})
+
+	t.Run("should do a single attempt when not configured", func(t *testing.T) {
+		assert.Equal(t, 1, newRetryPolicy(RetryConfig{}).attempts())
+	})
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	now := time.Date(2021, 8, 25, 8, 30, 0, 0, time.UTC)
+	p := newRetryPolicy(RetryConfig{BaseDelay: time.Second, MaxDelay: time.Minute})
+
+	t.Run("should honour retry-after in seconds", func(t *testing.T) {
+		res := &http.Response{Header: http.Header{"Retry-After": []string{"7"}}}
+		wait, ok := p.delay(1, res, now)
+		assert.True(t, ok)
+		assert.Equal(t, time.Second*7, wait)
+	})
+
+	t.Run("should honour retry-after as a date", func(t *testing.T) {
+		res := &http.Response{Header: http.Header{"Retry-After": []string{now.Add(time.Second * 30).Format(http.TimeFormat)}}}
+		wait, ok := p.delay(1, res, now)
+		assert.True(t, ok)
+		assert.Equal(t, time.Second*30, wait)
+	})
+
+	t.Run("should give up if retry-after exceeds max delay", func(t *testing.T) {
+		res := &http.Response{Header: http.Header{"Retry-After": []string{"3600"}}}
+		_, ok := p.delay(1, res, now)
+		assert.False(t, ok)
+	})
+
+	t.Run("should fall back to backoff without retry-after", func(t *testing.T) {
+		wait, ok := p.delay(2, &http.Response{Header: http.Header{}}, now)
+		assert.True(t, ok)
+		assert.Equal(t, time.Second*2, wait)
+	})
+}
+
+func TestIsRetryable(t *testing.T) {
+	get := httptest.NewRequest(http.MethodGet, "/", nil)
+	post := httptest.NewRequest(http.MethodPost, "/", nil)
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Err: errors.New("connection reset")}
+
+	t.Run("should retry connect errors for any method", func(t *testing.T) {
+		assert.True(t, isRetryable(get, nil, dialErr))
+		assert.True(t, isRetryable(post, nil, dialErr))
+	})
+
+	t.Run("should retry other network errors only for idempotent methods", func(t *testing.T) {
+		assert.True(t, isRetryable(get, nil, readErr))
+		assert.False(t, isRetryable(post, nil, readErr))
+	})
+
+	t.Run("should not retry non network errors", func(t *testing.T) {
+		assert.False(t, isRetryable(get, nil, errors.New("stopped after 10 redirects")))
+	})
+
+	t.Run("should retry 5xx and 429 but not other statuses", func(t *testing.T) {
+		assert.True(t, isRetryable(get, &http.Response{StatusCode: http.StatusBadGateway}, nil))
+		assert.True(t, isRetryable(get, &http.Response{StatusCode: http.StatusTooManyRequests}, nil))
+		assert.True(t, isRetryable(post, &http.Response{StatusCode: http.StatusTooManyRequests}, nil))
+		assert.False(t, isRetryable(get, &http.Response{StatusCode: http.StatusNotFound}, nil))
+		assert.False(t, isRetryable(get, &http.Response{StatusCode: http.StatusOK}, nil))
+	})
+
+	t.Run("should not retry 5xx for non idempotent methods", func(t *testing.T) {
+		assert.False(t, isRetryable(post, &http.Response{StatusCode: http.StatusBadGateway}, nil))
+	})
+}
+
+type mockClock struct {
+	now   time.Time
+	slept []time.Duration
+}
+
+func (m *mockClock) Now() time.Time {
+	return m.now
+}
+
+func (m *mockClock) Sleep(d time.Duration) {
+	m.slept = append(m.slept, d)
+	m.now = m.now.Add(d)
+}
+
+func newMockClock() *mockClock {
+	return &mockClock{now: time.Date(2021, 8, 25, 8, 30, 0, 0, time.UTC)}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	secretFilePrefix = "file:"
+	secretCmdPrefix  = "cmd:"
+	secretCmdTimeout = time.Second * 10
+)
+
+// resolveSecrets replaces file: and cmd: references in the secret settings
+// with what they point to, so the secrets themselves never sit in the toml.
+func resolveSecrets(c *Config) error {
+	secrets := map[string]*string{
+		"client_id":                  &c.ClientId,
+		"client_secret":              &c.ClientSecret,
+		"stream_signing.secret":      &c.StreamSigning.Secret,
+		"token_fallback.auth_header": &c.TokenFallback.AuthHeader,
+		"token_export.key":           &c.TokenExport.Key,
+		"token_store.redis_url":      &c.TokenStore.RedisUrl,
+		"redis_cache.url":            &c.RedisCache.Url,
+	}
+	for i := range c.ClientCredentials {
+		secrets[fmt.Sprintf("credentials[%d].client_id", i)] = &c.ClientCredentials[i].ClientId
+		secrets[fmt.Sprintf("credentials[%d].client_secret", i)] = &c.ClientCredentials[i].ClientSecret
+	}
+	for i := range c.ApiKeys {
+		secrets[fmt.Sprintf("api_keys[%d].key", i)] = &c.ApiKeys[i].Key
+	}
+	for name, secret := range secrets {
+		value, err := resolveSecret(*secret)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*secret = value
+	}
+	return nil
+}
+
+// resolveSecret reads file:/path/to/secret from disk and runs cmd:program args
+// (split on spaces, no shell), trimming surrounding whitespace. Anything else
+// is returned as is.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretFilePrefix):
+		path := strings.TrimPrefix(value, secretFilePrefix)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	case strings.HasPrefix(value, secretCmdPrefix):
+		args := strings.Fields(strings.TrimPrefix(value, secretCmdPrefix))
+		if len(args) == 0 {
+			return "", fmt.Errorf("empty secret command")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), secretCmdTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+		if err != nil {
+			return "", fmt.Errorf("secret command %s: %w", args[0], err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return value, nil
+}
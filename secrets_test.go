@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	t.Run("should keep plain values", func(t *testing.T) {
+		value, err := resolveSecret("micio")
+		assert.NoError(t, err)
+		assert.Equal(t, "micio", value)
+	})
+
+	t.Run("should read a file, trimming the trailing newline", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "client_secret")
+		_ = os.WriteFile(path, []byte("micio\n"), 0600)
+		value, err := resolveSecret("file:" + path)
+		assert.NoError(t, err)
+		assert.Equal(t, "micio", value)
+	})
+
+	t.Run("should fail on a missing file", func(t *testing.T) {
+		_, err := resolveSecret("file:" + filepath.Join(t.TempDir(), "nope"))
+		assert.Error(t, err)
+	})
+
+	t.Run("should run a command", func(t *testing.T) {
+		value, err := resolveSecret("cmd:echo micio")
+		assert.NoError(t, err)
+		assert.Equal(t, "micio", value)
+	})
+
+	t.Run("should fail on a failing command", func(t *testing.T) {
+		_, err := resolveSecret("cmd:false")
+		assert.Error(t, err)
+		_, err = resolveSecret("cmd:")
+		assert.Error(t, err)
+	})
+}
+
+func TestResolveSecrets(t *testing.T) {
+	t.Run("should resolve every secret setting", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "secret")
+		_ = os.WriteFile(path, []byte("from file"), 0600)
+		c := Config{
+			ClientId:      "plain",
+			ClientSecret:  "file:" + path,
+			StreamSigning: StreamSigningConfig{Secret: "cmd:echo signing"},
+			ApiKeys:       []ApiKey{{Name: "app", Key: "file:" + path}},
+		}
+		assert.NoError(t, resolveSecrets(&c))
+		assert.Equal(t, "plain", c.ClientId)
+		assert.Equal(t, "from file", c.ClientSecret)
+		assert.Equal(t, "signing", c.StreamSigning.Secret)
+		assert.Equal(t, "from file", c.ApiKeys[0].Key)
+	})
+
+	t.Run("should name the setting that failed", func(t *testing.T) {
+		c := Config{ClientSecret: "cmd:false"}
+		assert.ErrorContains(t, resolveSecrets(&c), "client_secret")
+	})
+}
@@ -1,29 +1,36 @@
 package main
 
 import (
-	"errors"
+	"fmt"
+	"net/url"
 )
 
 type HttpTrackDataService struct {
+	c   TrackDataCache
 	tr  TokenRepository
 	tdr TrackDataRepository
 }
 
-func NewHttpTrackDataService(tr TokenRepository, tdr TrackDataRepository) *HttpTrackDataService {
-	return &HttpTrackDataService{tr: tr, tdr: tdr}
+func NewHttpTrackDataService(c TrackDataCache, tr TokenRepository, tdr TrackDataRepository) *HttpTrackDataService {
+	return &HttpTrackDataService{c: c, tr: tr, tdr: tdr}
 }
 
 func (t *HttpTrackDataService) GetTrackData(id int) (map[string]interface{}, error) {
+	if track, ok := t.c.Get(id); ok {
+		return track, nil
+	}
+
 	token, err := t.tr.GetToken()
 	if err != nil {
-		return nil, errors.New("token not available")
+		return nil, newServiceError("token not available", err)
 	}
 
 	track, err := t.tdr.GetTrackData(token, id)
 	if err != nil {
-		return nil, errors.New("trackData not available")
+		return nil, newServiceError("trackData not available", err)
 	}
 
+	t.c.Add(id, track)
 	return track, nil
 }
 
@@ -31,28 +38,253 @@ type HttpCachedTrackService struct {
 	c   TrackCache
 	tr  TokenRepository
 	trr TrackRepository
+	v   TrackValidator
+}
+
+func NewHttpCachedTrackService(c TrackCache, tr TokenRepository, trr TrackRepository, v TrackValidator) *HttpCachedTrackService {
+	return &HttpCachedTrackService{c: c, tr: tr, trr: trr, v: v}
+}
+
+func (t *HttpCachedTrackService) GetTrack(id int) (Track, error) {
+	return t.c.GetOrLoad(TrackKey{Id: id}, func() (Track, error) {
+		token, err := t.tr.GetToken()
+		if err != nil {
+			return Track{}, newServiceError("token not available", err)
+		}
+
+		track, err := t.trr.GetTrack(token, id)
+		if err != nil {
+			return Track{}, newServiceError("track not available", err)
+		}
+
+		if err := t.v.Validate(id, track); err != nil {
+			return Track{}, newServiceError("track not available", err)
+		}
+
+		return track, nil
+	})
+}
+
+// HttpTranscodedTrackService transcodes the original track, as cached by
+// ts, caching each rendition on its own.
+type HttpTranscodedTrackService struct {
+	c  TrackCache
+	ts TrackService
+	t  Transcoder
 }
 
-func NewHttpCachedTrackService(c TrackCache, tr TokenRepository, trr TrackRepository) *HttpCachedTrackService {
-	return &HttpCachedTrackService{c: c, tr: tr, trr: trr}
+func NewHttpTranscodedTrackService(c TrackCache, ts TrackService, t Transcoder) *HttpTranscodedTrackService {
+	return &HttpTranscodedTrackService{c: c, ts: ts, t: t}
 }
 
-func (t *HttpCachedTrackService) GetTrack(id int) ([]byte, error) {
-	if t.c.Contains(id) {
-		track, _ := t.c.Get(id)
+func (t *HttpTranscodedTrackService) GetRendition(id int, r Rendition) (Track, error) {
+	return t.c.GetOrLoad(TrackKey{Id: id, Rendition: r.String()}, func() (Track, error) {
+		original, err := t.ts.GetTrack(id)
+		if err != nil {
+			return Track{}, err
+		}
+
+		track, err := t.t.Transcode(original, r)
+		if err != nil {
+			return Track{}, newServiceError("transcoding not available", err)
+		}
+
 		return track, nil
+	})
+}
+
+// HttpWaveformService gets the waveform of a track from SoundCloud or draws
+// it from the cached track, keeping it at full resolution and resampling it
+// for every request.
+type HttpWaveformService struct {
+	c      WaveformCache
+	source string
+	tr     TokenRepository
+	tds    TrackDataService
+	wr     WaveformRepository
+	ts     TrackService
+}
+
+func NewHttpWaveformService(c WaveformCache, source string, tr TokenRepository, tds TrackDataService, wr WaveformRepository, ts TrackService) *HttpWaveformService {
+	return &HttpWaveformService{c: c, source: source, tr: tr, tds: tds, wr: wr, ts: ts}
+}
+
+func (w *HttpWaveformService) GetWaveform(id int, samples int) (Waveform, error) {
+	if waveform, ok := w.c.Get(id); ok {
+		return waveform.Resample(samples), nil
+	}
+
+	var waveform Waveform
+	var err error
+	if w.source == waveformSourcePeaks {
+		waveform, err = w.peaks(id)
+	} else {
+		waveform, err = w.soundcloud(id)
+	}
+	if err != nil {
+		return Waveform{}, err
 	}
 
+	w.c.Add(id, waveform)
+	return waveform.Resample(samples), nil
+}
+
+func (w *HttpWaveformService) soundcloud(id int) (Waveform, error) {
+	trackData, err := w.tds.GetTrackData(id)
+	if err != nil {
+		return Waveform{}, err
+	}
+
+	waveformUrl, err := waveformJsonUrl(trackData)
+	if err != nil {
+		return Waveform{}, newServiceError("waveform not available", err)
+	}
+
+	token, err := w.tr.GetToken()
+	if err != nil {
+		return Waveform{}, newServiceError("token not available", err)
+	}
+
+	waveform, err := w.wr.GetWaveform(token, waveformUrl)
+	if err != nil {
+		return Waveform{}, newServiceError("waveform not available", err)
+	}
+
+	return waveform, nil
+}
+
+func (w *HttpWaveformService) peaks(id int) (Waveform, error) {
+	track, err := w.ts.GetTrack(id)
+	if err != nil {
+		return Waveform{}, err
+	}
+
+	if track.ContentType != "audio/mpeg" {
+		return Waveform{}, newServiceError("waveform not available", fmt.Errorf("peaks need an mp3 stream, got %s", track.ContentType))
+	}
+
+	waveform, err := mp3Peaks(track.Data)
+	if err != nil {
+		return Waveform{}, newServiceError("waveform not available", err)
+	}
+
+	return waveform, nil
+}
+
+type HttpTrackUrlService struct {
+	tr  TokenRepository
+	tur TrackUrlRepository
+}
+
+func NewHttpTrackUrlService(tr TokenRepository, tur TrackUrlRepository) *HttpTrackUrlService {
+	return &HttpTrackUrlService{tr: tr, tur: tur}
+}
+
+func (t *HttpTrackUrlService) GetTrackUrl(id int) (string, error) {
 	token, err := t.tr.GetToken()
 	if err != nil {
-		return nil, errors.New("token not available")
+		return "", newServiceError("token not available", err)
 	}
 
-	track, err := t.trr.GetTrack(token, id)
+	trackUrl, err := t.tur.GetTrackUrl(token, id)
 	if err != nil {
-		return nil, errors.New("track not available")
+		return "", newServiceError("track url not available", err)
 	}
 
-	t.c.Add(id, track)
+	return trackUrl, nil
+}
+
+type HttpHlsService struct {
+	p  PlaylistCache
+	s  SegmentCache
+	tr TokenRepository
+	hr HlsRepository
+}
+
+func NewHttpHlsService(p PlaylistCache, s SegmentCache, tr TokenRepository, hr HlsRepository) *HttpHlsService {
+	return &HttpHlsService{p: p, s: s, tr: tr, hr: hr}
+}
+
+func (h *HttpHlsService) GetPlaylist(id int) ([]byte, error) {
+	token, err := h.tr.GetToken()
+	if err != nil {
+		return nil, newServiceError("token not available", err)
+	}
+
+	playlist, err := h.hr.GetHlsPlaylist(token, id)
+	if err != nil {
+		return nil, newServiceError("hls playlist not available", err)
+	}
+
+	rewritten, err := rewriteHlsPlaylist(playlist.Body)
+	if err != nil {
+		return nil, newServiceError("hls playlist not available", err)
+	}
+
+	h.p.Add(id, playlist)
+	return rewritten, nil
+}
+
+func (h *HttpHlsService) GetSegment(id int, segment string) (Track, error) {
+	key := fmt.Sprintf("%d/%s", id, segment)
+	if track, ok := h.s.Get(key); ok {
+		return track, nil
+	}
+
+	token, err := h.tr.GetToken()
+	if err != nil {
+		return Track{}, newServiceError("token not available", err)
+	}
+
+	track, err := h.fetchSegment(token, id, segment)
+	if err != nil {
+		return Track{}, newServiceError("hls segment not available", err)
+	}
+
+	h.s.Add(key, track)
 	return track, nil
 }
+
+// fetchSegment resolves the segment against the last playlist served for the
+// track, refetching the playlist once in case its signed urls expired.
+func (h *HttpHlsService) fetchSegment(token Token, id int, segment string) (Track, error) {
+	playlist, cached := h.p.Get(id)
+	if !cached {
+		fresh, err := h.hr.GetHlsPlaylist(token, id)
+		if err != nil {
+			return Track{}, err
+		}
+		playlist = fresh
+		h.p.Add(id, playlist)
+	}
+
+	segmentUrl, err := resolveSegmentUrl(playlist, segment)
+	if err != nil {
+		return Track{}, err
+	}
+
+	data, err := h.hr.GetHlsSegment(token, segmentUrl)
+	if err != nil && cached {
+		h.p.Remove(id)
+		return h.fetchSegment(token, id, segment)
+	}
+	if err != nil {
+		return Track{}, err
+	}
+
+	return Track{Data: data, ContentType: playlist.ContentType}, nil
+}
+
+func resolveSegmentUrl(playlist HlsPlaylist, segment string) (string, error) {
+	base, err := url.Parse(playlist.Url)
+	if err != nil {
+		return "", err
+	}
+
+	parsed, err := parseHlsPlaylist(playlist.Body, base)
+	if err != nil {
+		return "", err
+	}
+
+	return parsed.segmentUrl(segment)
+}
@@ -13,50 +13,207 @@ func TestHttpTrackDataService_GetTrackData(t *testing.T) {
 		expected := make(map[string]interface{})
 		expected["id"] = 1
 		expected["token"] = "bau"
-		got, _ := NewHttpTrackDataService(mockTokenRepository{}, mockTrackDataRepository{}).GetTrackData(1)
+		got, _ := NewHttpTrackDataService(newMemoryTrackDataCacheForTest(), mockTokenRepository{}, mockTrackDataRepository{}).GetTrackData(1)
 		assert.Equal(t, got, expected)
 	})
 
 	t.Run("should emit token not available if token cannot be gained", func(t *testing.T) {
-		_, err := NewHttpTrackDataService(newFailingMockTokenRepo("no token"), mockTrackDataRepository{}).GetTrackData(1)
+		_, err := NewHttpTrackDataService(newMemoryTrackDataCacheForTest(), newFailingMockTokenRepo("no token"), mockTrackDataRepository{}).GetTrackData(1)
 		assert.Equal(t, err.Error(), "token not available")
 	})
 
 	t.Run("should emit track data not available if track data cannot be gained", func(t *testing.T) {
-		_, err := NewHttpTrackDataService(mockTokenRepository{}, mockTrackDataRepository{wantErr: true, errMsg: "error"}).GetTrackData(1)
+		_, err := NewHttpTrackDataService(newMemoryTrackDataCacheForTest(), mockTokenRepository{}, mockTrackDataRepository{wantErr: true, errMsg: "error"}).GetTrackData(1)
 		assert.Equal(t, err.Error(), "trackData not available")
 	})
+
+	t.Run("should serve cached track data without asking upstream", func(t *testing.T) {
+		cache := newMemoryTrackDataCacheForTest()
+		_, _ = NewHttpTrackDataService(cache, mockTokenRepository{}, mockTrackDataRepository{}).GetTrackData(1)
+		got, err := NewHttpTrackDataService(cache, newFailingMockTokenRepo("no token"), mockTrackDataRepository{}).GetTrackData(1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, got["id"])
+	})
 }
 
 func TestHttpCachedTrackService_GetTrack(t *testing.T) {
 	t.Run("should work ok, pass the token", func(t *testing.T) {
-		cache, _ := lru.New[int, []byte](1)
-		got, _ := NewHttpCachedTrackService(cache, mockTokenRepository{}, mockTrackRepository{}).GetTrack(1)
-		assert.Equal(t, got, []byte(`bau1`))
+		cache, _ := NewMemoryTrackCache(1)
+		got, _ := NewHttpCachedTrackService(cache, mockTokenRepository{}, mockTrackRepository{}, mockTrackValidator{}).GetTrack(1)
+		assert.Equal(t, got, Track{Data: []byte(`bau1`), ContentType: "audio/mpeg"})
 	})
 
 	t.Run("should fetch from cache if available", func(t *testing.T) {
 		cache := newMockLruCache()
-		service := NewHttpCachedTrackService(cache, mockTokenRepository{}, mockTrackRepository{})
+		service := NewHttpCachedTrackService(cache, mockTokenRepository{}, mockTrackRepository{}, mockTrackValidator{})
 		_, _ = service.GetTrack(1)
 		assert.False(t, cache.used)
 		_, _ = service.GetTrack(1)
 		assert.True(t, cache.used)
 	})
 
+	t.Run("should keep serving cached tracks while upstream is unavailable", func(t *testing.T) {
+		cache, _ := NewMemoryTrackCache(1)
+		cache.Add(TrackKey{Id: 1}, Track{Data: []byte(`cached`), ContentType: "audio/mpeg"})
+		got, err := NewHttpCachedTrackService(cache, newFailingMockTokenRepo("circuit open"), mockTrackRepository{wantErr: true}, mockTrackValidator{}).GetTrack(1)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(`cached`), got.Data)
+	})
+
+	t.Run("should keep the upstream cause reachable", func(t *testing.T) {
+		cache, _ := NewMemoryTrackCache(1)
+		_, err := NewHttpCachedTrackService(cache, mockTokenRepository{}, mockTrackRepository{err: &CircuitOpenError{}}, mockTrackValidator{}).GetTrack(1)
+		var open *CircuitOpenError
+		assert.True(t, errors.As(err, &open))
+		assert.Equal(t, "track not available", err.Error())
+	})
+
+	t.Run("should not cache tracks failing validation", func(t *testing.T) {
+		cache, _ := NewMemoryTrackCache(1)
+		_, err := NewHttpCachedTrackService(cache, mockTokenRepository{}, mockTrackRepository{}, mockTrackValidator{err: errors.New("html")}).GetTrack(1)
+		assert.Equal(t, "track not available", err.Error())
+		assert.False(t, cache.Contains(TrackKey{Id: 1}))
+	})
+
 	t.Run("should emit token not available if token cannot be gained", func(t *testing.T) {
-		cache, _ := lru.New[int, []byte](1)
-		_, err := NewHttpCachedTrackService(cache, newFailingMockTokenRepo("no token"), mockTrackRepository{}).GetTrack(1)
+		cache, _ := NewMemoryTrackCache(1)
+		_, err := NewHttpCachedTrackService(cache, newFailingMockTokenRepo("no token"), mockTrackRepository{}, mockTrackValidator{}).GetTrack(1)
 		assert.Equal(t, err.Error(), "token not available")
 	})
 
 	t.Run("should emit track data not available if track data cannot be gained", func(t *testing.T) {
-		cache, _ := lru.New[int, []byte](1)
-		_, err := NewHttpCachedTrackService(cache, mockTokenRepository{}, mockTrackRepository{wantErr: true, errMsg: "error"}).GetTrack(1)
+		cache, _ := NewMemoryTrackCache(1)
+		_, err := NewHttpCachedTrackService(cache, mockTokenRepository{}, mockTrackRepository{wantErr: true, errMsg: "error"}, mockTrackValidator{}).GetTrack(1)
 		assert.Equal(t, err.Error(), "track not available")
 	})
 }
 
+func TestHttpTrackUrlService_GetTrackUrl(t *testing.T) {
+	t.Run("should work ok, pass the token", func(t *testing.T) {
+		got, _ := NewHttpTrackUrlService(mockTokenRepository{}, mockTrackUrlRepository{}).GetTrackUrl(1)
+		assert.Equal(t, "https://cdn/bau/1", got)
+	})
+
+	t.Run("should emit token not available if token cannot be gained", func(t *testing.T) {
+		_, err := NewHttpTrackUrlService(newFailingMockTokenRepo("no token"), mockTrackUrlRepository{}).GetTrackUrl(1)
+		assert.Equal(t, err.Error(), "token not available")
+	})
+
+	t.Run("should emit track url not available if the url cannot be gained", func(t *testing.T) {
+		_, err := NewHttpTrackUrlService(mockTokenRepository{}, mockTrackUrlRepository{wantErr: true, errMsg: "error"}).GetTrackUrl(1)
+		assert.Equal(t, err.Error(), "track url not available")
+	})
+}
+
+func TestHttpHlsService(t *testing.T) {
+	newService := func(hr *mockHlsRepository) (*HttpHlsService, *lru.Cache[string, Track]) {
+		playlists, _ := lru.New[int, HlsPlaylist](10)
+		segments, _ := lru.New[string, Track](10)
+		return NewHttpHlsService(playlists, segments, mockTokenRepository{}, hr), segments
+	}
+
+	t.Run("should serve the rewritten playlist", func(t *testing.T) {
+		service, _ := newService(&mockHlsRepository{})
+		got, err := service.GetPlaylist(1)
+		assert.NoError(t, err)
+		assert.Equal(t, "#EXTM3U\n#EXTINF:10,\nsegments/0\n#EXTINF:10,\nsegments/1\n", string(got))
+	})
+
+	t.Run("should fetch segments through the playlist and cache them", func(t *testing.T) {
+		hr := &mockHlsRepository{}
+		service, segments := newService(hr)
+		_, _ = service.GetPlaylist(1)
+		got, err := service.GetSegment(1, "1")
+		assert.NoError(t, err)
+		assert.Equal(t, Track{Data: []byte("https://cdn/1/seg1.mp3"), ContentType: "audio/mpeg"}, got)
+		assert.True(t, segments.Contains("1/1"))
+		_, _ = service.GetSegment(1, "1")
+		assert.Equal(t, 1, hr.playlistCalls)
+		assert.Equal(t, 1, hr.segmentCalls)
+	})
+
+	t.Run("should fetch the playlist if a segment is asked first", func(t *testing.T) {
+		hr := &mockHlsRepository{}
+		service, _ := newService(hr)
+		got, err := service.GetSegment(1, "0")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("https://cdn/1/seg0.mp3"), got.Data)
+		assert.Equal(t, 1, hr.playlistCalls)
+	})
+
+	t.Run("should refetch the playlist once if its signed urls expired", func(t *testing.T) {
+		hr := &mockHlsRepository{failSegments: 1}
+		service, _ := newService(hr)
+		_, _ = service.GetPlaylist(1)
+		got, err := service.GetSegment(1, "0")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("https://cdn/1/seg0.mp3"), got.Data)
+		assert.Equal(t, 2, hr.playlistCalls)
+	})
+
+	t.Run("should emit hls segment not available for unknown segments", func(t *testing.T) {
+		service, _ := newService(&mockHlsRepository{})
+		_, err := service.GetSegment(1, "7")
+		assert.Equal(t, "hls segment not available", err.Error())
+	})
+
+	t.Run("should emit hls playlist not available if upstream fails", func(t *testing.T) {
+		service, _ := newService(&mockHlsRepository{wantErr: true})
+		_, err := service.GetPlaylist(1)
+		assert.Equal(t, "hls playlist not available", err.Error())
+	})
+
+	t.Run("should emit token not available if token cannot be gained", func(t *testing.T) {
+		playlists, _ := lru.New[int, HlsPlaylist](10)
+		segments, _ := lru.New[string, Track](10)
+		service := NewHttpHlsService(playlists, segments, newFailingMockTokenRepo("no token"), &mockHlsRepository{})
+		_, err := service.GetPlaylist(1)
+		assert.Equal(t, "token not available", err.Error())
+		_, err = service.GetSegment(1, "0")
+		assert.Equal(t, "token not available", err.Error())
+	})
+}
+
+type mockHlsRepository struct {
+	wantErr       bool
+	failSegments  int
+	playlistCalls int
+	segmentCalls  int
+}
+
+func (m *mockHlsRepository) GetHlsPlaylist(_ Token, id int) (HlsPlaylist, error) {
+	m.playlistCalls++
+	if m.wantErr {
+		return HlsPlaylist{}, errors.New("error")
+	}
+	return HlsPlaylist{
+		Url:         fmt.Sprintf("https://cdn/%d/playlist.m3u8", id),
+		Body:        []byte("#EXTM3U\n#EXTINF:10,\nseg0.mp3\n#EXTINF:10,\nseg1.mp3\n"),
+		ContentType: "audio/mpeg",
+	}, nil
+}
+
+func (m *mockHlsRepository) GetHlsSegment(_ Token, segmentUrl string) ([]byte, error) {
+	m.segmentCalls++
+	if m.failSegments > 0 {
+		m.failSegments--
+		return nil, errors.New("expired")
+	}
+	return []byte(segmentUrl), nil
+}
+
+type mockTrackUrlRepository struct {
+	wantErr bool
+	errMsg  string
+}
+
+func (m mockTrackUrlRepository) GetTrackUrl(t Token, id int) (string, error) {
+	if m.wantErr {
+		return "", errors.New(m.errMsg)
+	}
+	return fmt.Sprintf("https://cdn/%s/%d", t.AccessToken, id), nil
+}
+
 type mockTrackDataRepository struct {
 	wantErr bool
 	errMsg  string
@@ -91,35 +248,79 @@ func newFailingMockTokenRepo(errMsg string) *mockTokenRepository {
 type mockTrackRepository struct {
 	wantErr bool
 	errMsg  string
+	err     error
 }
 
-func (m mockTrackRepository) GetTrack(t Token, id int) ([]byte, error) {
+func (m mockTrackRepository) GetTrack(t Token, id int) (Track, error) {
+	if m.err != nil {
+		return Track{}, m.err
+	}
 	if m.wantErr {
-		return nil, errors.New(m.errMsg)
+		return Track{}, errors.New(m.errMsg)
 	}
-	return []byte(fmt.Sprintf("%s%d", t.AccessToken, id)), nil
+	return Track{Data: []byte(fmt.Sprintf("%s%d", t.AccessToken, id)), ContentType: "audio/mpeg"}, nil
+}
+
+type mockTrackValidator struct {
+	err error
+}
+
+func (m mockTrackValidator) Validate(_ int, _ Track) error {
+	return m.err
 }
 
 type mockLruCache struct {
-	cache map[int][]byte
+	cache map[TrackKey]Track
 	used  bool
 }
 
-func (m *mockLruCache) Add(key int, value []byte) (evicted bool) {
+func (m *mockLruCache) Add(key TrackKey, value Track) (evicted bool) {
 	m.cache[key] = value
 	return false
 }
 
-func (m *mockLruCache) Contains(key int) bool {
+func (m *mockLruCache) Contains(key TrackKey) bool {
 	_, ok := m.cache[key]
 	return ok
 }
 
-func (m *mockLruCache) Get(key int) (value []byte, ok bool) {
+func (m *mockLruCache) Get(key TrackKey) (value Track, ok bool) {
 	m.used = true
 	return m.cache[key], true
 }
 
+func (m *mockLruCache) GetOrLoad(key TrackKey, load func() (Track, error)) (Track, error) {
+	if m.Contains(key) {
+		track, _ := m.Get(key)
+		return track, nil
+	}
+	track, err := load()
+	if err == nil {
+		m.Add(key, track)
+	}
+	return track, err
+}
+
+func (m *mockLruCache) Remove(key TrackKey) (present bool) {
+	_, present = m.cache[key]
+	delete(m.cache, key)
+	return present
+}
+
+func (m *mockLruCache) Keys() []TrackKey {
+	var keys []TrackKey
+	for key := range m.cache {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (m *mockLruCache) Stats() CacheStats {
+	return CacheStats{Entries: len(m.cache)}
+}
+
+func (m *mockLruCache) OnEvict(_ func(key TrackKey, value Track)) {}
+
 func newMockLruCache() *mockLruCache {
-	return &mockLruCache{cache: make(map[int][]byte)}
+	return &mockLruCache{cache: make(map[TrackKey]Track)}
 }
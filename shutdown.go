@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Stoppable is implemented by background workers and by whatever holds
+// state that has to be flushed before the process exits.
+type Stoppable interface {
+	Stop(ctx context.Context) error
+}
+
+type StopFunc func(ctx context.Context) error
+
+func (f StopFunc) Stop(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Serve runs start until SIGINT or SIGTERM, then stops accepting connections
+// and lets in-flight requests finish for up to drain before closing them.
+// The stoppables are stopped in order afterwards, each within drain.
+func Serve(e *echo.Echo, start func() error, drain time.Duration, stoppables ...Stoppable) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return serve(ctx, e, start, drain, stoppables)
+}
+
+func serve(ctx context.Context, e *echo.Echo, start func() error, drain time.Duration, stoppables []Stoppable) error {
+	started := make(chan error, 1)
+	go func() {
+		started <- start()
+	}()
+	select {
+	case err := <-started:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down, draining in-flight requests for up to %s", drain)
+	drainCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := e.Shutdown(drainCtx); err != nil {
+		log.Printf("drain deadline exceeded, closing the remaining connections: %v", err)
+		_ = e.Close()
+	}
+
+	var errs []error
+	for _, s := range stoppables {
+		stopCtx, cancel := context.WithTimeout(context.Background(), drain)
+		errs = append(errs, s.Stop(stopCtx))
+		cancel()
+	}
+	return errors.Join(errs...)
+}
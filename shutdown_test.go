@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newShutdownTestServer(t *testing.T, handlerTime time.Duration) (*echo.Echo, string, chan struct{}) {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	inFlight := make(chan struct{})
+	e.GET("/", func(c echo.Context) error {
+		close(inFlight)
+		time.Sleep(handlerTime)
+		return c.String(http.StatusOK, "micio")
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Listener = listener
+	return e, "http://" + listener.Addr().String(), inFlight
+}
+
+func TestServe(t *testing.T) {
+	t.Run("should drain in-flight requests and then stop", func(t *testing.T) {
+		e, url, inFlight := newShutdownTestServer(t, time.Millisecond*100)
+		ctx, cancel := context.WithCancel(context.Background())
+		var stopped []string
+		done := make(chan error)
+		go func() {
+			done <- serve(ctx, e, func() error { return e.Start("") }, time.Second, []Stoppable{
+				StopFunc(func(_ context.Context) error { stopped = append(stopped, "refresher"); return nil }),
+				StopFunc(func(_ context.Context) error { stopped = append(stopped, "cache"); return nil }),
+			})
+		}()
+
+		type result struct {
+			body string
+			err  error
+		}
+		responses := make(chan result)
+		go func() {
+			res, err := http.Get(url)
+			if err != nil {
+				responses <- result{err: err}
+				return
+			}
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			responses <- result{string(body), err}
+		}()
+		<-inFlight
+		cancel()
+
+		r := <-responses
+		assert.NoError(t, r.err)
+		assert.Equal(t, "micio", r.body)
+		assert.NoError(t, <-done)
+		assert.Equal(t, []string{"refresher", "cache"}, stopped)
+		_, err := http.Get(url)
+		assert.Error(t, err)
+	})
+
+	t.Run("should cut requests still running at the deadline", func(t *testing.T) {
+		e, url, inFlight := newShutdownTestServer(t, time.Second)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- serve(ctx, e, func() error { return e.Start("") }, time.Millisecond*50, nil)
+		}()
+		failed := make(chan error)
+		go func() {
+			_, err := http.Get(url)
+			failed <- err
+		}()
+		<-inFlight
+		cancel()
+		assert.NoError(t, <-done)
+		assert.Error(t, <-failed)
+	})
+
+	t.Run("should report stop failures", func(t *testing.T) {
+		e, _, _ := newShutdownTestServer(t, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := serve(ctx, e, func() error { return e.Start("") }, time.Second, []Stoppable{
+			StopFunc(func(_ context.Context) error { return errors.New("flush failed") }),
+		})
+		assert.ErrorContains(t, err, "flush failed")
+	})
+
+	t.Run("should return start errors", func(t *testing.T) {
+		err := serve(context.Background(), echo.New(), func() error { return errors.New("address in use") }, time.Second, nil)
+		assert.ErrorContains(t, err, "address in use")
+	})
+}
@@ -4,33 +4,128 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/giorgiovilardo/etnograbber/clock"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
-	"time"
+	"sync/atomic"
 )
 
 const AuthApiSuccessStatus = http.StatusOK
 
+const defaultMaxRedirects = 10
+
+var defaultHlsFormats = []string{"hls_mp3_128", "hls_aac_160", "hls_opus_64"}
+
 type HttpSoundcloudApi struct {
-	c Config
+	c       atomic.Pointer[Config]
+	clock   clock.Clock
+	breaker *CircuitBreaker
+	limiter *UpstreamLimiter
+	// client follows redirects through checkRedirect, noRedirectClient hands
+	// them back; both share one transport and its pool of connections.
+	client           *http.Client
+	noRedirectClient *http.Client
+	fallbackClient   *http.Client
+	fallbackErr      error
+	observer         CredentialObserver
+}
+
+func NewHttpSoundcloudApi(c Config, clock clock.Clock) *HttpSoundcloudApi {
+	transport := NewUpstreamTransport(c.UpstreamHttp)
+	s := &HttpSoundcloudApi{
+		clock:   clock,
+		breaker: NewCircuitBreaker(c.CircuitBreaker, clock),
+		limiter: NewUpstreamLimiter(c.UpstreamRateLimit, clock),
+		noRedirectClient: &http.Client{Transport: transport, CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+			return http.ErrUseLastResponse
+		}},
+	}
+	s.client = &http.Client{Transport: transport, CheckRedirect: s.checkRedirect}
+	s.fallbackClient, s.fallbackErr = newFallbackClient(c.TokenFallback, c.UpstreamHttp, s.client, clock)
+	s.c.Store(&c)
+	return s
+}
+
+// Reload swaps the settings that only affect how upstream is called and the
+// secrets of the credentials, the credentials themselves, urls and the
+// transport keep their startup values.
+func (s *HttpSoundcloudApi) Reload(c Config) {
+	next := *s.config()
+	next.ClientId = c.ClientId
+	next.ClientSecret = c.ClientSecret
+	next.ClientCredentials = c.ClientCredentials
+	next.MaxRedirects = c.MaxRedirects
+	next.StreamFormats = c.StreamFormats
+	next.Retry = c.Retry
+	next.CircuitBreaker = c.CircuitBreaker
+	next.UpstreamRateLimit = c.UpstreamRateLimit
+	next.UpstreamHttp.AuthTimeout = c.UpstreamHttp.AuthTimeout
+	next.UpstreamHttp.MetadataTimeout = c.UpstreamHttp.MetadataTimeout
+	next.UpstreamHttp.StreamConnectTimeout = c.UpstreamHttp.StreamConnectTimeout
+	next.UpstreamHttp.StreamIdleTimeout = c.UpstreamHttp.StreamIdleTimeout
+	s.c.Store(&next)
+	s.breaker.Reload(c.CircuitBreaker)
+	s.limiter.Reload(c.UpstreamRateLimit)
+}
+
+func (s *HttpSoundcloudApi) config() *Config {
+	return s.c.Load()
+}
+
+func (s *HttpSoundcloudApi) Breaker() *CircuitBreaker {
+	return s.breaker
+}
+
+func (s *HttpSoundcloudApi) Limiter() *UpstreamLimiter {
+	return s.limiter
+}
+
+// SetCredentialObserver lets observer see every upstream answer, it has to be
+// called before the first request.
+func (s *HttpSoundcloudApi) SetCredentialObserver(observer CredentialObserver) {
+	s.observer = observer
+}
+
+// observeCredential reports whether the observer took care of a rate limit,
+// in which case it is not applied to every outbound call.
+func (s *HttpSoundcloudApi) observeCredential(req *http.Request, res *http.Response) bool {
+	return s.observer != nil && s.observer.ObserveResponse(req, res)
+}
+
+func (s *HttpSoundcloudApi) authTimeouts() requestTimeouts {
+	return requestTimeouts{total: s.config().UpstreamHttp.AuthTimeout}
+}
+
+func (s *HttpSoundcloudApi) metadataTimeouts() requestTimeouts {
+	return requestTimeouts{total: s.config().UpstreamHttp.MetadataTimeout}
 }
 
-func NewHttpSoundcloudApi(c Config) *HttpSoundcloudApi {
-	return &HttpSoundcloudApi{c: c}
+func (s *HttpSoundcloudApi) streamTimeouts() requestTimeouts {
+	c := s.config().UpstreamHttp
+	return requestTimeouts{header: c.StreamConnectTimeout, idle: c.StreamIdleTimeout}
 }
 
 func (s *HttpSoundcloudApi) GetTrackData(t Token, id int) (map[string]interface{}, error) {
-	trackUrl := fmt.Sprintf("%s/%d", s.c.BaseApiUrl, id)
+	trackUrl := fmt.Sprintf("%s/%d", s.config().BaseApiUrl, id)
 	authHeader := fmt.Sprintf("OAuth %s", t.AccessToken)
-	client := http.Client{Timeout: time.Second * 5}
-	req, _ := http.NewRequest(http.MethodGet, trackUrl, nil)
-	req.Header.Set("Authorization", authHeader)
-	res, err := client.Do(req)
-	if err != nil || res.StatusCode != http.StatusOK {
+	res, err := s.send(s.client, s.metadataTimeouts(), func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, trackUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", authHeader)
+		return req, nil
+	})
+	if err != nil {
 		return nil, errors.Join(errors.New("failed to get track data"), err)
 	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get track data, status %d", res.StatusCode)
+	}
 
 	result := make(map[string]interface{})
 
@@ -46,27 +141,291 @@ func (s *HttpSoundcloudApi) GetTrackData(t Token, id int) (map[string]interface{
 	return result, nil
 }
 
-func (s *HttpSoundcloudApi) GetTrack(t Token, id int) ([]byte, error) {
-	trackUrl := fmt.Sprintf("%s/%d/stream", s.c.BaseApiUrl, id)
-	authHeader := fmt.Sprintf("OAuth %s", t.AccessToken)
-	client := http.Client{Timeout: time.Second * 20}
-	req, _ := http.NewRequest(http.MethodGet, trackUrl, nil)
-	req.Header.Set("Authorization", authHeader)
-	res, err := client.Do(req)
-	if err != nil || res.StatusCode != http.StatusOK {
-		return nil, errors.Join(errors.New("failed to get track stream"), err)
+func (s *HttpSoundcloudApi) GetWaveform(t Token, waveformUrl string) (Waveform, error) {
+	body, err := s.fetch(t, waveformUrl)
+	if err != nil {
+		return Waveform{}, errors.Join(errors.New("failed to get waveform"), err)
 	}
 
-	body, err := io.ReadAll(res.Body)
+	var waveform Waveform
+	if err = json.Unmarshal(body, &waveform); err != nil {
+		return Waveform{}, errors.Join(errors.New("failed to jsonize waveform"), err)
+	}
+
+	return waveform, nil
+}
+
+func (s *HttpSoundcloudApi) GetTrack(t Token, id int) (Track, error) {
+	if len(s.config().StreamFormats) == 0 {
+		body, err := s.fetch(t, fmt.Sprintf("%s/%d/stream", s.config().BaseApiUrl, id))
+		if err != nil {
+			return Track{}, errors.Join(errors.New("failed to get track stream"), err)
+		}
+		return Track{Data: body, ContentType: legacyStreamContentType}, nil
+	}
+
+	transcodings, err := s.getTranscodings(t, id)
+	if err != nil {
+		return Track{}, errors.Join(errors.New("failed to get track stream"), err)
+	}
+
+	for _, name := range s.config().StreamFormats {
+		transcodingUrl, ok := transcodings[name+"_url"]
+		if !ok || transcodingUrl == "" {
+			continue
+		}
+		format := streamFormats[name]
+		var body []byte
+		if format.hls {
+			body, err = s.fetchHls(t, transcodingUrl)
+		} else {
+			body, err = s.fetch(t, transcodingUrl)
+		}
+		if err != nil {
+			return Track{}, errors.Join(fmt.Errorf("failed to get track stream %s", name), err)
+		}
+		return Track{Data: body, ContentType: format.contentType}, nil
+	}
+
+	return Track{}, errors.New("failed to get track stream, no preferred format available")
+}
+
+func (s *HttpSoundcloudApi) GetHlsPlaylist(t Token, id int) (HlsPlaylist, error) {
+	transcodings, err := s.getTranscodings(t, id)
+	if err != nil {
+		return HlsPlaylist{}, errors.Join(errors.New("failed to get hls playlist"), err)
+	}
+
+	for _, name := range s.hlsFormats() {
+		playlistUrl, ok := transcodings[name+"_url"]
+		if !ok || playlistUrl == "" {
+			continue
+		}
+		body, err := s.fetch(t, playlistUrl)
+		if err != nil {
+			return HlsPlaylist{}, errors.Join(fmt.Errorf("failed to get hls playlist %s", name), err)
+		}
+		return HlsPlaylist{Url: playlistUrl, Body: body, ContentType: streamFormats[name].contentType}, nil
+	}
+
+	return HlsPlaylist{}, errors.New("failed to get hls playlist, no hls format available")
+}
+
+func (s *HttpSoundcloudApi) GetHlsSegment(t Token, segmentUrl string) ([]byte, error) {
+	body, err := s.fetch(t, segmentUrl)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to get hls segment"), err)
+	}
+
+	return body, nil
+}
+
+func (s *HttpSoundcloudApi) hlsFormats() []string {
+	var formats []string
+	for _, name := range s.config().StreamFormats {
+		if streamFormats[name].hls {
+			formats = append(formats, name)
+		}
+	}
+	if len(formats) == 0 {
+		return defaultHlsFormats
+	}
+	return formats
+}
+
+func (s *HttpSoundcloudApi) getTranscodings(t Token, id int) (map[string]string, error) {
+	body, err := s.fetch(t, fmt.Sprintf("%s/%d/streams", s.config().BaseApiUrl, id))
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to get track streams"), err)
+	}
+
+	result := make(map[string]string)
+	if err = json.Unmarshal(body, &result); err != nil {
+		return nil, errors.Join(errors.New("failed to jsonize track streams"), err)
+	}
+
+	return result, nil
+}
+
+// fetchHls downloads an HLS media playlist and concatenates its segments,
+// which yields a playable file for the mp3, fmp4 and ogg transcodings.
+func (s *HttpSoundcloudApi) fetchHls(t Token, playlistUrl string) ([]byte, error) {
+	base, err := url.Parse(playlistUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := s.fetch(t, playlistUrl)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to get hls playlist"), err)
+	}
+
+	playlist, err := parseHlsPlaylist(body, base)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to parse hls playlist"), err)
+	}
+
+	segments := playlist.segments
+	if playlist.initSegment != "" {
+		segments = append([]string{playlist.initSegment}, segments...)
+	}
+
+	var result []byte
+	for _, segmentUrl := range segments {
+		segment, err := s.fetch(t, segmentUrl)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to get hls segment"), err)
+		}
+		result = append(result, segment...)
+	}
+
+	return result, nil
+}
+
+// fetch GETs a stream resource, sending the token only to the api host.
+func (s *HttpSoundcloudApi) fetch(t Token, resourceUrl string) ([]byte, error) {
+	res, err := s.send(s.client, s.streamTimeouts(), func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, resourceUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		if s.isApiHost(req.URL) {
+			req.Header.Set("Authorization", fmt.Sprintf("OAuth %s", t.AccessToken))
+		}
+		return req, nil
+	})
 	if err != nil {
-		return nil, errors.Join(errors.New("failed to get track stream"), err)
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d from %s", res.StatusCode, res.Request.URL.Host)
 	}
 
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.ContentLength >= 0 && int64(len(body)) != res.ContentLength {
+		return nil, fmt.Errorf("got %d of %d bytes from %s", len(body), res.ContentLength, res.Request.URL.Host)
+	}
 	return body, nil
 }
 
+func (s *HttpSoundcloudApi) isApiHost(u *url.URL) bool {
+	apiUrl, err := url.Parse(s.config().BaseApiUrl)
+	return err == nil && apiUrl.Host == u.Host
+}
+
+// GetTrackUrl picks the first progressive format of StreamFormats, as a
+// redirect has to point at a playable file, and falls back to the legacy
+// stream when the track or the preferences have none.
+func (s *HttpSoundcloudApi) GetTrackUrl(t Token, id int) (string, error) {
+	legacyUrl := fmt.Sprintf("%s/%d/stream", s.config().BaseApiUrl, id)
+	if len(s.progressiveFormats()) == 0 {
+		return s.resolveTrackUrl(t, legacyUrl)
+	}
+
+	transcodings, err := s.getTranscodings(t, id)
+	if err != nil {
+		return "", errors.Join(errors.New("failed to get track url"), err)
+	}
+
+	for _, name := range s.progressiveFormats() {
+		transcodingUrl, ok := transcodings[name+"_url"]
+		if !ok || transcodingUrl == "" {
+			continue
+		}
+		u, err := url.Parse(transcodingUrl)
+		if err != nil {
+			return "", errors.Join(fmt.Errorf("failed to get track url %s", name), err)
+		}
+		if !s.isApiHost(u) {
+			return transcodingUrl, nil
+		}
+		return s.resolveTrackUrl(t, transcodingUrl)
+	}
+
+	return s.resolveTrackUrl(t, legacyUrl)
+}
+
+func (s *HttpSoundcloudApi) progressiveFormats() []string {
+	var formats []string
+	for _, name := range s.config().StreamFormats {
+		if format, ok := streamFormats[name]; ok && !format.hls {
+			formats = append(formats, name)
+		}
+	}
+	return formats
+}
+
+// resolveTrackUrl asks the api for trackUrl and returns where it redirects,
+// the signed CDN url that can be handed to clients.
+func (s *HttpSoundcloudApi) resolveTrackUrl(t Token, trackUrl string) (string, error) {
+	authHeader := fmt.Sprintf("OAuth %s", t.AccessToken)
+	res, err := s.send(s.noRedirectClient, s.metadataTimeouts(), func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, trackUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", authHeader)
+		return req, nil
+	})
+	if err != nil {
+		return "", errors.Join(errors.New("failed to get track url"), err)
+	}
+	defer res.Body.Close()
+
+	location, err := res.Location()
+	if err != nil {
+		return "", fmt.Errorf("failed to get track url, stream answered %d without a location", res.StatusCode)
+	}
+
+	return location.String(), nil
+}
+
+// Auth and Renew act as the first configured credential, ForCredential
+// gives the same for any other.
 func (s *HttpSoundcloudApi) Auth() ([]byte, error) {
-	tokenData, err := s.getToken()
+	return s.authAs(s.config().Credentials()[0])
+}
+
+func (s *HttpSoundcloudApi) Renew(t Token) ([]byte, error) {
+	return s.renewAs(s.config().Credentials()[0], t)
+}
+
+func (s *HttpSoundcloudApi) ForCredential(c Credential) SoundcloudApi {
+	return credentialApi{s: s, c: c}
+}
+
+type credentialApi struct {
+	s *HttpSoundcloudApi
+	c Credential
+}
+
+func (a credentialApi) Auth() ([]byte, error) {
+	return a.s.authAs(a.s.credential(a.c))
+}
+
+func (a credentialApi) Renew(t Token) ([]byte, error) {
+	return a.s.renewAs(a.s.credential(a.c), t)
+}
+
+// credential looks c up by name in the running config, so rotated client
+// ids and secrets are picked up on reload. A credential the reload dropped
+// keeps its startup values.
+func (s *HttpSoundcloudApi) credential(c Credential) Credential {
+	for _, current := range s.config().Credentials() {
+		if current.Name == c.Name {
+			return current
+		}
+	}
+	return c
+}
+
+func (s *HttpSoundcloudApi) authAs(c Credential) ([]byte, error) {
+	tokenData, err := s.getToken(c)
 	if err == nil {
 		return tokenData, nil
 	}
@@ -79,19 +438,18 @@ func (s *HttpSoundcloudApi) Auth() ([]byte, error) {
 	return fallbackTokenData, nil
 }
 
-func (s *HttpSoundcloudApi) Renew(t Token) ([]byte, error) {
+func (s *HttpSoundcloudApi) renewAs(c Credential, t Token) ([]byte, error) {
 	formData := url.Values{}
 	formData.Add("grant_type", "refresh_token")
-	formData.Add("client_id", s.c.ClientId)
-	formData.Add("client_secret", s.c.ClientSecret)
+	formData.Add("client_id", c.ClientId)
+	formData.Add("client_secret", c.ClientSecret)
 	formData.Add("refresh_token", t.RefreshToken)
 
-	client := http.Client{Timeout: time.Second * 5}
-
-	res, err := client.Post(s.c.BaseAuthUrl, "application/x-www-form-urlencoded", strings.NewReader(formData.Encode()))
+	res, err := s.send(s.client, s.authTimeouts(), newFormRequest(s.config().BaseAuthUrl, formData))
 	if err != nil {
 		return nil, errors.Join(errors.New("could not renew the token, post failed"), err)
 	}
+	defer res.Body.Close()
 
 	result, err := io.ReadAll(res.Body)
 	if err != nil {
@@ -101,18 +459,17 @@ func (s *HttpSoundcloudApi) Renew(t Token) ([]byte, error) {
 	return result, nil
 }
 
-func (s *HttpSoundcloudApi) getToken() ([]byte, error) {
+func (s *HttpSoundcloudApi) getToken(c Credential) ([]byte, error) {
 	formData := url.Values{}
 	formData.Add("grant_type", "client_credentials")
-	formData.Add("client_id", s.c.ClientId)
-	formData.Add("client_secret", s.c.ClientSecret)
+	formData.Add("client_id", c.ClientId)
+	formData.Add("client_secret", c.ClientSecret)
 
-	client := http.Client{Timeout: time.Second * 5}
-
-	res, err := client.Post(s.c.BaseAuthUrl, "application/x-www-form-urlencoded", strings.NewReader(formData.Encode()))
+	res, err := s.send(s.client, s.authTimeouts(), newFormRequest(s.config().BaseAuthUrl, formData))
 	if err != nil {
 		return nil, errors.Join(errors.New("failed to get token from BaseAuth, network error"), err)
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != AuthApiSuccessStatus {
 		return nil, fmt.Errorf("failed to get token from BaseAuth, status not %d", AuthApiSuccessStatus)
@@ -126,13 +483,28 @@ func (s *HttpSoundcloudApi) getToken() ([]byte, error) {
 	return result, nil
 }
 
+// getFallback asks token_generator_fallback for a token, authenticating
+// with the configured header or client certificate, and only accepts a
+// well formed token living at least min_ttl.
 func (s *HttpSoundcloudApi) getFallback() ([]byte, error) {
-	client := http.Client{Timeout: time.Second * 5}
-
-	res, err := client.Get(s.c.FallbackAuthUrl)
+	if s.fallbackErr != nil {
+		return nil, errors.Join(errors.New("failed to get token from FallbackAuth"), s.fallbackErr)
+	}
+	fallback := s.config().TokenFallback
+	res, err := s.send(s.fallbackClient, s.authTimeouts(), func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, s.config().FallbackAuthUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		if fallback.AuthHeader != "" {
+			req.Header.Set("Authorization", fallback.AuthHeader)
+		}
+		return req, nil
+	})
 	if err != nil {
 		return nil, errors.Join(errors.New("failed to get token from FallbackAuth"), err)
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != AuthApiSuccessStatus {
 		return nil, fmt.Errorf("failed to get token from FallbackAuth, status not %d", AuthApiSuccessStatus)
@@ -143,5 +515,109 @@ func (s *HttpSoundcloudApi) getFallback() ([]byte, error) {
 		return nil, errors.Join(errors.New("unparsable api body"), err)
 	}
 
-	return result, nil
+	token, err := validateFallbackToken(result, s.clock.Now(), fallback.MinTtl)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(token)
+}
+
+// send performs the request built by newRequest through the circuit breaker,
+// counting as failures what is left of network errors and 5xx after retries.
+// A 429 that survives the retries is turned into a RateLimitedError; it
+// counts neither way, like a call the limiter kept from going out.
+func (s *HttpSoundcloudApi) send(client *http.Client, timeouts requestTimeouts, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	if err := s.breaker.Allow(); err != nil {
+		return nil, err
+	}
+
+	res, err := s.sendWithRetry(client, timeouts, newRequest)
+	var limited *RateLimitedError
+	switch {
+	case errors.As(err, &limited) || (res != nil && res.StatusCode == http.StatusTooManyRequests):
+		s.breaker.Release()
+	case err != nil || res.StatusCode >= http.StatusInternalServerError:
+		s.breaker.Failure()
+	default:
+		s.breaker.Success()
+	}
+
+	if res != nil && res.StatusCode == http.StatusTooManyRequests {
+		_ = res.Body.Close()
+		// a credential benched by the pool did not pause the limiter
+		wait := s.limiter.PausedFor()
+		if own, ok := rateLimitWait(res, s.clock.Now()); ok && own > wait {
+			wait = own
+		}
+		return nil, &RateLimitedError{wait: wait}
+	}
+
+	return res, err
+}
+
+// sendWithRetry retries the request according to the retry policy. Requests
+// are rebuilt on every attempt as bodies can only be read once, and every
+// attempt goes through the upstream limiter. A rate limit the credential pool
+// took care of is not retried, the request would carry the benched
+// credential's token again; the next call gets another one.
+func (s *HttpSoundcloudApi) sendWithRetry(client *http.Client, timeouts requestTimeouts, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	retry := newRetryPolicy(s.config().Retry)
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.limiter.Wait(); err != nil {
+			return nil, err
+		}
+
+		res, err := doWithTimeouts(client, req, timeouts)
+		handled := res != nil && s.observeCredential(req, res)
+		if res != nil && !handled {
+			s.limiter.Observe(res)
+		}
+		if handled || attempt >= retry.attempts() || !isRetryable(req, res, err) {
+			return res, err
+		}
+
+		wait, ok := retry.delay(attempt, res, s.clock.Now())
+		if !ok {
+			return res, err
+		}
+		if res != nil {
+			_, _ = io.Copy(io.Discard, res.Body)
+			_ = res.Body.Close()
+		}
+		s.clock.Sleep(wait)
+	}
+}
+
+func newFormRequest(postUrl string, formData url.Values) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, postUrl, strings.NewReader(formData.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	}
+}
+
+// checkRedirect caps the number of followed redirects and drops the
+// Authorization header as soon as a hop leaves the original host, so the
+// OAuth token never reaches the CDN serving the signed stream url.
+func (s *HttpSoundcloudApi) checkRedirect(req *http.Request, via []*http.Request) error {
+	maxRedirects := s.config().MaxRedirects
+	if maxRedirects <= 0 {
+		maxRedirects = defaultMaxRedirects
+	}
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if req.URL.Host != via[0].URL.Host {
+		req.Header.Del("Authorization")
+	}
+	return nil
 }
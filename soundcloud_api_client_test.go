@@ -1,11 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	clockLib "github.com/giorgiovilardo/etnograbber/clock"
 	"github.com/stretchr/testify/assert"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHttpSoundcloudApi_Renew(t *testing.T) {
@@ -17,7 +22,7 @@ func TestHttpSoundcloudApi_Renew(t *testing.T) {
 		}))
 		defer server.Close()
 		conf := Config{BaseAuthUrl: server.URL}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		res, _ := api.Renew(Token{})
 		assert.Equal(t, expected, res)
 	})
@@ -34,13 +39,13 @@ func TestHttpSoundcloudApi_Renew(t *testing.T) {
 		}))
 		defer server.Close()
 		conf := Config{BaseAuthUrl: server.URL, ClientId: "micio", ClientSecret: "mao"}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		_, _ = api.Renew(Token{RefreshToken: "reftoken"})
 	})
 
 	t.Run("should fail if it can't make the request", func(t *testing.T) {
 		conf := Config{BaseAuthUrl: "bad server"}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		res, err := api.Renew(Token{})
 		assert.Equal(t, []byte(nil), res)
 		assert.Contains(t, err.Error(), "could not renew the token, post failed")
@@ -56,44 +61,44 @@ func TestHttpSoundcloudApi_Auth(t *testing.T) {
 		}))
 		defer server.Close()
 		conf := Config{BaseAuthUrl: server.URL}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		res, _ := api.Auth()
 		assert.Equal(t, expected, res)
 	})
 
 	t.Run("should fetch the token from fallback url if base has network error", func(t *testing.T) {
-		expected := []byte(`{"ola":"ola"}`)
+		fallbackToken := []byte(`{"access_token":"miao","expires_in":3599,"refresh_token":"bau","scope":"","token_type":"bearer"}`)
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(AuthApiSuccessStatus)
-			_, _ = w.Write(expected)
+			_, _ = w.Write(fallbackToken)
 		}))
 		defer server.Close()
 		conf := Config{BaseAuthUrl: "not a server", FallbackAuthUrl: server.URL}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		res, _ := api.Auth()
-		assert.Equal(t, expected, res)
+		assert.JSONEq(t, `{"access_token":"miao","expires_in":3599,"refresh_token":"bau","scope":"","token_type":"bearer","source":"fallback"}`, string(res))
 	})
 
 	t.Run("should use the fallback auth if base has server errors", func(t *testing.T) {
-		expected := []byte(`{"ola":"ola"}`)
+		fallbackToken := []byte(`{"access_token":"miao","expires_in":3599,"refresh_token":"bau","scope":"","token_type":"bearer"}`)
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 		}))
 		fallbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(AuthApiSuccessStatus)
-			_, _ = w.Write(expected)
+			_, _ = w.Write(fallbackToken)
 		}))
 		defer server.Close()
 		defer fallbackServer.Close()
 		conf := Config{BaseAuthUrl: server.URL, FallbackAuthUrl: fallbackServer.URL}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		res, _ := api.Auth()
-		assert.Equal(t, expected, res)
+		assert.JSONEq(t, `{"access_token":"miao","expires_in":3599,"refresh_token":"bau","scope":"","token_type":"bearer","source":"fallback"}`, string(res))
 	})
 
 	t.Run("should error with both base and fallback auth unavailable", func(t *testing.T) {
 		conf := Config{BaseAuthUrl: "bad server", FallbackAuthUrl: "bad server"}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		res, err := api.Auth()
 		assert.Equal(t, []byte(nil), res)
 		assert.Contains(t, err.Error(), "impossible to acquire a token")
@@ -110,7 +115,7 @@ func TestHttpSoundcloudApi_Auth(t *testing.T) {
 		}))
 		defer server.Close()
 		conf := Config{BaseAuthUrl: server.URL, ClientId: "micio", ClientSecret: "mao"}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		_, _ = api.Auth()
 	})
 
@@ -125,7 +130,7 @@ func TestHttpSoundcloudApi_Auth(t *testing.T) {
 		}))
 		defer server.Close()
 		conf := Config{FallbackAuthUrl: server.URL, ClientId: "micio", ClientSecret: "mao"}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		_, _ = api.Auth()
 	})
 
@@ -141,7 +146,7 @@ func TestHttpSoundcloudApi_Auth(t *testing.T) {
 		defer server.Close()
 		defer fallbackServer.Close()
 		conf := Config{BaseAuthUrl: server.URL, FallbackAuthUrl: fallbackServer.URL}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		res, err := api.Auth()
 		assert.Equal(t, []byte(nil), res)
 		assert.Contains(t, err.Error(), "failed to get token from BaseAuth, status not 200")
@@ -163,14 +168,14 @@ func TestHttpSoundcloudApi_GetTrackData(t *testing.T) {
 		}))
 		defer server.Close()
 		conf := Config{BaseApiUrl: server.URL}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		res, _ := api.GetTrackData(token, id)
 		assert.Equal(t, expected, res)
 	})
 
 	t.Run("should fail with network error", func(t *testing.T) {
 		conf := Config{BaseApiUrl: "YOLO"}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		_, err := api.GetTrackData(Token{}, 0)
 		assert.Contains(t, err.Error(), "failed to get track data")
 	})
@@ -180,12 +185,36 @@ func TestHttpSoundcloudApi_GetTrackData(t *testing.T) {
 			w.WriteHeader(http.StatusServiceUnavailable)
 		}))
 		conf := Config{BaseApiUrl: server.URL}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		_, err := api.GetTrackData(Token{}, 0)
 		assert.Contains(t, err.Error(), "failed to get track data")
 	})
 }
 
+func TestHttpSoundcloudApi_GetWaveform(t *testing.T) {
+	t.Run("should fetch the waveform without sending the token off the api host", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, r.Header.Get("Authorization"))
+			_, _ = w.Write([]byte(`{"width":3,"height":140,"samples":[1,2,3]}`))
+		}))
+		defer server.Close()
+		api := NewHttpSoundcloudApi(Config{BaseApiUrl: "https://api.soundcloud.com/tracks"}, clockLib.NewRealClock())
+		got, err := api.GetWaveform(Token{AccessToken: "faketoken"}, server.URL+"/abc_m.json")
+		assert.NoError(t, err)
+		assert.Equal(t, Waveform{Width: 3, Height: 140, Samples: []int{1, 2, 3}}, got)
+	})
+
+	t.Run("should fail on a body that is not a waveform", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`<html>`))
+		}))
+		defer server.Close()
+		api := NewHttpSoundcloudApi(Config{BaseApiUrl: server.URL}, clockLib.NewRealClock())
+		_, err := api.GetWaveform(Token{}, server.URL+"/abc_m.json")
+		assert.Contains(t, err.Error(), "failed to jsonize waveform")
+	})
+}
+
 func TestHttpSoundcloudApi_GetTrack(t *testing.T) {
 	t.Run("should work correctly", func(t *testing.T) {
 		token := Token{AccessToken: "faketoken"}
@@ -199,14 +228,14 @@ func TestHttpSoundcloudApi_GetTrack(t *testing.T) {
 		}))
 		defer server.Close()
 		conf := Config{BaseApiUrl: server.URL}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		res, _ := api.GetTrack(token, id)
-		assert.Equal(t, []byte(`{"fake":"result"}`), res)
+		assert.Equal(t, Track{Data: []byte(`{"fake":"result"}`), ContentType: "audio/mpeg"}, res)
 	})
 
 	t.Run("should fail with network error", func(t *testing.T) {
 		conf := Config{BaseApiUrl: "YOLO"}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		_, err := api.GetTrack(Token{}, 0)
 		assert.Contains(t, err.Error(), "failed to get track stream")
 	})
@@ -216,8 +245,605 @@ func TestHttpSoundcloudApi_GetTrack(t *testing.T) {
 			w.WriteHeader(http.StatusServiceUnavailable)
 		}))
 		conf := Config{BaseApiUrl: server.URL}
-		api := NewHttpSoundcloudApi(conf)
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
 		_, err := api.GetTrack(Token{}, 0)
 		assert.Contains(t, err.Error(), "failed to get track stream")
 	})
+
+	t.Run("should follow the redirect to the cdn without leaking the token", func(t *testing.T) {
+		cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, r.Header.Get("Authorization"))
+			_, _ = w.Write([]byte(`mp3`))
+		}))
+		defer cdn.Close()
+		cdnUrl := strings.Replace(cdn.URL, "127.0.0.1", "localhost", 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "OAuth faketoken", r.Header.Get("Authorization"))
+			http.Redirect(w, r, cdnUrl+"/signed", http.StatusFound)
+		}))
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		res, err := api.GetTrack(Token{AccessToken: "faketoken"}, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(`mp3`), res.Data)
+	})
+
+	t.Run("should keep the token on same host redirects", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "OAuth faketoken", r.Header.Get("Authorization"))
+			if r.URL.Path != "/moved" {
+				http.Redirect(w, r, "/moved", http.StatusFound)
+				return
+			}
+			_, _ = w.Write([]byte(`mp3`))
+		}))
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		res, _ := api.GetTrack(Token{AccessToken: "faketoken"}, 1)
+		assert.Equal(t, []byte(`mp3`), res.Data)
+	})
+
+	t.Run("should stop following redirects after max_redirects", func(t *testing.T) {
+		hops := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hops++
+			http.Redirect(w, r, fmt.Sprintf("/hop%d", hops), http.StatusFound)
+		}))
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, MaxRedirects: 3}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		_, err := api.GetTrack(Token{}, 1)
+		assert.Contains(t, err.Error(), "stopped after 3 redirects")
+		assert.Equal(t, 3, hops)
+	})
+	t.Run("should fail when the body is shorter than its Content-Length", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "100")
+			_, _ = w.Write([]byte(`truncated`))
+		}))
+		defer server.Close()
+		api := NewHttpSoundcloudApi(Config{BaseApiUrl: server.URL}, clockLib.NewRealClock())
+		_, err := api.GetTrack(Token{}, 1)
+		assert.Contains(t, err.Error(), "failed to get track stream")
+	})
+}
+
+func TestHttpSoundcloudApi_GetTrack_Transcodings(t *testing.T) {
+	newStreamsServer := func(streams func(base string) string) *httptest.Server {
+		mux := http.NewServeMux()
+		server := httptest.NewServer(mux)
+		mux.HandleFunc("/100/streams", func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "OAuth faketoken", r.Header.Get("Authorization"))
+			_, _ = w.Write([]byte(streams(server.URL)))
+		})
+		mux.HandleFunc("/progressive.mp3", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`progressive`))
+		})
+		mux.HandleFunc("/opus/playlist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-MAP:URI=\"init.opus\"\n#EXTINF:10,\nseg0.opus\n#EXTINF:10,\nseg1.opus\n#EXT-X-ENDLIST\n"))
+		})
+		mux.HandleFunc("/opus/", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/opus/")))
+		})
+		return server
+	}
+
+	t.Run("should pick the first preferred format that is available", func(t *testing.T) {
+		server := newStreamsServer(func(base string) string {
+			return fmt.Sprintf(`{"http_mp3_128_url":"%s/progressive.mp3","hls_opus_64_url":"%s/opus/playlist.m3u8"}`, base, base)
+		})
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, StreamFormats: []string{"hls_aac_160", "http_mp3_128", "hls_opus_64"}}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		res, err := api.GetTrack(Token{AccessToken: "faketoken"}, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, Track{Data: []byte(`progressive`), ContentType: "audio/mpeg"}, res)
+	})
+
+	t.Run("should concatenate the init and media segments of an hls transcoding", func(t *testing.T) {
+		server := newStreamsServer(func(base string) string {
+			return fmt.Sprintf(`{"http_mp3_128_url":"%s/progressive.mp3","hls_opus_64_url":"%s/opus/playlist.m3u8"}`, base, base)
+		})
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, StreamFormats: []string{"hls_opus_64", "http_mp3_128"}}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		res, err := api.GetTrack(Token{AccessToken: "faketoken"}, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, Track{Data: []byte(`init.opusseg0.opusseg1.opus`), ContentType: "audio/ogg"}, res)
+	})
+
+	t.Run("should fail if no preferred format is available", func(t *testing.T) {
+		server := newStreamsServer(func(base string) string {
+			return fmt.Sprintf(`{"http_mp3_128_url":"%s/progressive.mp3"}`, base)
+		})
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, StreamFormats: []string{"hls_aac_160"}}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		_, err := api.GetTrack(Token{AccessToken: "faketoken"}, 100)
+		assert.Contains(t, err.Error(), "no preferred format available")
+	})
+
+	t.Run("should not send the token to hosts other than the api", func(t *testing.T) {
+		cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, r.Header.Get("Authorization"))
+			_, _ = w.Write([]byte(`cdn`))
+		}))
+		defer cdn.Close()
+		server := newStreamsServer(func(_ string) string {
+			return fmt.Sprintf(`{"http_mp3_128_url":"%s/progressive.mp3"}`, cdn.URL)
+		})
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, StreamFormats: []string{"http_mp3_128"}}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		res, _ := api.GetTrack(Token{AccessToken: "faketoken"}, 100)
+		assert.Equal(t, []byte(`cdn`), res.Data)
+	})
+}
+
+func TestHttpSoundcloudApi_GetHlsPlaylist(t *testing.T) {
+	newStreamsServer := func(streams string) *httptest.Server {
+		mux := http.NewServeMux()
+		server := httptest.NewServer(mux)
+		mux.HandleFunc("/100/streams", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(strings.ReplaceAll(streams, "BASE", server.URL)))
+		})
+		mux.HandleFunc("/aac/playlist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "OAuth faketoken", r.Header.Get("Authorization"))
+			_, _ = w.Write([]byte("#EXTM3U\n#EXTINF:10,\nseg0.m4s\n"))
+		})
+		return server
+	}
+
+	t.Run("should return the playlist of the first hls format available", func(t *testing.T) {
+		server := newStreamsServer(`{"http_mp3_128_url":"BASE/progressive.mp3","hls_aac_160_url":"BASE/aac/playlist.m3u8"}`)
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, StreamFormats: []string{"http_mp3_128", "hls_aac_160"}}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		res, err := api.GetHlsPlaylist(Token{AccessToken: "faketoken"}, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, HlsPlaylist{Url: server.URL + "/aac/playlist.m3u8", Body: []byte("#EXTM3U\n#EXTINF:10,\nseg0.m4s\n"), ContentType: "audio/mp4"}, res)
+	})
+
+	t.Run("should fall back to any hls format if none is configured", func(t *testing.T) {
+		server := newStreamsServer(`{"hls_aac_160_url":"BASE/aac/playlist.m3u8"}`)
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		res, err := api.GetHlsPlaylist(Token{AccessToken: "faketoken"}, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, "audio/mp4", res.ContentType)
+	})
+
+	t.Run("should fail if the track has no hls format", func(t *testing.T) {
+		server := newStreamsServer(`{"http_mp3_128_url":"BASE/progressive.mp3"}`)
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		_, err := api.GetHlsPlaylist(Token{AccessToken: "faketoken"}, 100)
+		assert.Contains(t, err.Error(), "no hls format available")
+	})
+}
+
+func TestHttpSoundcloudApi_GetHlsSegment(t *testing.T) {
+	t.Run("should download the segment", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`segment`))
+		}))
+		defer server.Close()
+		api := NewHttpSoundcloudApi(Config{}, clockLib.NewRealClock())
+		res, err := api.GetHlsSegment(Token{}, server.URL+"/seg0.mp3")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(`segment`), res)
+	})
+
+	t.Run("should fail with non 200 response", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer server.Close()
+		api := NewHttpSoundcloudApi(Config{}, clockLib.NewRealClock())
+		_, err := api.GetHlsSegment(Token{}, server.URL+"/seg0.mp3")
+		assert.Contains(t, err.Error(), "failed to get hls segment")
+	})
+}
+
+func TestHttpSoundcloudApi_GetTrackUrl(t *testing.T) {
+	t.Run("should return the signed url the stream redirects to", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "OAuth faketoken", r.Header.Get("Authorization"))
+			assert.Equal(t, "/100/stream", r.URL.RequestURI())
+			http.Redirect(w, r, "https://cdn.example.com/track.mp3?Signature=abc", http.StatusFound)
+		}))
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		res, err := api.GetTrackUrl(Token{AccessToken: "faketoken"}, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, "https://cdn.example.com/track.mp3?Signature=abc", res)
+	})
+
+	t.Run("should redirect to the first progressive format preferred", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/100/streams", r.URL.RequestURI())
+			_, _ = w.Write([]byte(`{"hls_aac_160_url":"https://cdn.example.com/track.m3u8","http_mp3_128_url":"https://cdn.example.com/track.mp3?Policy=abc"}`))
+		}))
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, StreamFormats: []string{"hls_aac_160", "http_mp3_128"}}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		res, err := api.GetTrackUrl(Token{AccessToken: "faketoken"}, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, "https://cdn.example.com/track.mp3?Policy=abc", res)
+	})
+
+	t.Run("should follow a progressive format served by the api", func(t *testing.T) {
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "OAuth faketoken", r.Header.Get("Authorization"))
+			switch r.URL.Path {
+			case "/100/streams":
+				_, _ = w.Write([]byte(`{"http_mp3_128_url":"` + server.URL + `/100/streams/http_mp3_128"}`))
+			case "/100/streams/http_mp3_128":
+				http.Redirect(w, r, "https://cdn.example.com/track.mp3?Policy=abc", http.StatusFound)
+			default:
+				t.Errorf("unexpected request %s", r.URL.Path)
+			}
+		}))
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, StreamFormats: []string{"http_mp3_128"}}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		res, err := api.GetTrackUrl(Token{AccessToken: "faketoken"}, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, "https://cdn.example.com/track.mp3?Policy=abc", res)
+	})
+
+	t.Run("should fall back to the legacy stream without a progressive format", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/100/streams":
+				_, _ = w.Write([]byte(`{"hls_mp3_128_url":"https://cdn.example.com/track.m3u8"}`))
+			case "/100/stream":
+				http.Redirect(w, r, "https://cdn.example.com/legacy.mp3", http.StatusFound)
+			}
+		}))
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, StreamFormats: []string{"http_mp3_128", "hls_mp3_128"}}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		res, err := api.GetTrackUrl(Token{}, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, "https://cdn.example.com/legacy.mp3", res)
+	})
+
+	t.Run("should fail if the stream does not redirect", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`mp3`))
+		}))
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		_, err := api.GetTrackUrl(Token{}, 100)
+		assert.Contains(t, err.Error(), "stream answered 200 without a location")
+	})
+
+	t.Run("should fail with network error", func(t *testing.T) {
+		conf := Config{BaseApiUrl: "YOLO"}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		_, err := api.GetTrackUrl(Token{}, 0)
+		assert.Contains(t, err.Error(), "failed to get track url")
+	})
+}
+
+func TestHttpSoundcloudApi_Retry(t *testing.T) {
+	retry := RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond * 100, MaxDelay: time.Second}
+
+	t.Run("should retry transient failures with backoff", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls < 3 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write([]byte(`{"fake":"result"}`))
+		}))
+		defer server.Close()
+		clock := newMockClock()
+		api := NewHttpSoundcloudApi(Config{BaseApiUrl: server.URL, Retry: retry}, clock)
+		res, err := api.GetTrackData(Token{}, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"fake": "result"}, res)
+		assert.Equal(t, []time.Duration{time.Millisecond * 100, time.Millisecond * 200}, clock.slept)
+	})
+
+	t.Run("should give up after max attempts", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+		api := NewHttpSoundcloudApi(Config{BaseApiUrl: server.URL, Retry: retry}, newMockClock())
+		_, err := api.GetTrack(Token{}, 1)
+		assert.Contains(t, err.Error(), "failed to get track stream")
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("should wait what retry-after asks on 429", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(AuthApiSuccessStatus)
+		}))
+		defer server.Close()
+		clock := newMockClock()
+		api := NewHttpSoundcloudApi(Config{BaseAuthUrl: server.URL, Retry: retry}, clock)
+		_, err := api.Auth()
+		assert.NoError(t, err)
+		assert.Equal(t, []time.Duration{time.Second}, clock.slept)
+	})
+
+	t.Run("should resend the form body on every attempt", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			assert.Equal(t, "reftoken", r.PostFormValue("refresh_token"))
+			if calls == 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			_, _ = w.Write([]byte(`renewed`))
+		}))
+		defer server.Close()
+		api := NewHttpSoundcloudApi(Config{BaseAuthUrl: server.URL, Retry: retry}, newMockClock())
+		res, _ := api.Renew(Token{RefreshToken: "reftoken"})
+		assert.Equal(t, []byte(`renewed`), res)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("should not retry a token post on 5xx", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer server.Close()
+		clock := newMockClock()
+		api := NewHttpSoundcloudApi(Config{BaseAuthUrl: server.URL, Retry: retry}, clock)
+		_, _ = api.Renew(Token{RefreshToken: "reftoken"})
+		assert.Equal(t, 1, calls)
+		assert.Empty(t, clock.slept)
+	})
+
+	t.Run("should not retry client errors", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+		clock := newMockClock()
+		api := NewHttpSoundcloudApi(Config{BaseApiUrl: server.URL, Retry: retry}, clock)
+		_, _ = api.GetTrackData(Token{}, 1)
+		assert.Equal(t, 1, calls)
+		assert.Empty(t, clock.slept)
+	})
+}
+
+func TestHttpSoundcloudApi_CircuitBreaker(t *testing.T) {
+	t.Run("should fail fast without calling upstream once the circuit opens", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: time.Minute}}
+		api := NewHttpSoundcloudApi(conf, newMockClock())
+		_, _ = api.GetTrackData(Token{}, 1)
+		_, _ = api.GetTrack(Token{}, 1)
+		_, err := api.GetTrackData(Token{}, 1)
+		var open *CircuitOpenError
+		assert.True(t, errors.As(err, &open))
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, CircuitOpen, api.Breaker().State())
+	})
+
+	t.Run("should not count client errors as failures", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute}}
+		api := NewHttpSoundcloudApi(conf, newMockClock())
+		_, _ = api.GetTrackData(Token{}, 1)
+		assert.Equal(t, CircuitClosed, api.Breaker().State())
+	})
+}
+
+func TestHttpSoundcloudApi_RateLimit(t *testing.T) {
+	t.Run("should surface a 429 as a rate limited error and pause every call", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, BaseAuthUrl: server.URL, Retry: RetryConfig{MaxAttempts: 3, MaxDelay: time.Second}}
+		api := NewHttpSoundcloudApi(conf, newMockClock())
+		_, err := api.GetTrack(Token{}, 1)
+		var limited *RateLimitedError
+		assert.True(t, errors.As(err, &limited))
+		assert.Equal(t, time.Hour, limited.RetryAfter())
+		_, err = api.Renew(Token{})
+		assert.True(t, errors.As(err, &limited))
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("should not open the circuit because of rate limits", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute}}
+		api := NewHttpSoundcloudApi(conf, newMockClock())
+		_, _ = api.GetTrackData(Token{}, 1)
+		_, _ = api.GetTrackData(Token{}, 1)
+		assert.Equal(t, CircuitClosed, api.Breaker().State())
+	})
+
+	t.Run("should not close a half-open circuit on rate limits", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer server.Close()
+		clock := newMockClock()
+		conf := Config{BaseApiUrl: server.URL, CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute}}
+		api := NewHttpSoundcloudApi(conf, clock)
+		_, _ = api.GetTrackData(Token{}, 1)
+		clock.Sleep(time.Minute)
+		_, err := api.GetTrackData(Token{}, 1)
+		var limited *RateLimitedError
+		assert.True(t, errors.As(err, &limited))
+		assert.Equal(t, CircuitHalfOpen, api.Breaker().State())
+		_, err = api.GetTrackData(Token{}, 1)
+		assert.True(t, errors.As(err, &limited))
+		assert.Equal(t, CircuitHalfOpen, api.Breaker().State())
+		assert.Equal(t, 2, calls)
+	})
+}
+
+func TestHttpSoundcloudApi_Reload(t *testing.T) {
+	t.Run("should apply new upstream settings and credentials but keep urls", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			assert.Equal(t, "changed", r.PostFormValue("client_id"))
+			if calls == 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer server.Close()
+		api := NewHttpSoundcloudApi(Config{BaseAuthUrl: server.URL, ClientId: "micio"}, newMockClock())
+		api.Reload(Config{BaseAuthUrl: "bad server", ClientId: "changed", Retry: RetryConfig{MaxAttempts: 2}, CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute}})
+		_, _ = api.Renew(Token{})
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, CircuitOpen, api.Breaker().State())
+	})
+}
+
+func TestHttpSoundcloudApi_Transport(t *testing.T) {
+	t.Run("should reuse connections across calls", func(t *testing.T) {
+		connections := 0
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"id":1}`))
+		}))
+		server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				connections++
+			}
+		}
+		server.Start()
+		defer server.Close()
+		api := NewHttpSoundcloudApi(Config{BaseApiUrl: server.URL}, clockLib.NewRealClock())
+		for i := 0; i < 3; i++ {
+			_, err := api.GetTrackData(Token{}, 1)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, 1, connections)
+	})
+
+	t.Run("should time out slow metadata calls", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		defer server.Close()
+		conf := Config{BaseApiUrl: server.URL, UpstreamHttp: UpstreamHttpConfig{MetadataTimeout: time.Millisecond * 20}}
+		api := NewHttpSoundcloudApi(conf, clockLib.NewRealClock())
+		_, err := api.GetTrackData(Token{}, 1)
+		assert.ErrorContains(t, err, "failed to get track data")
+	})
+}
+
+func TestHttpSoundcloudApi_ForCredential(t *testing.T) {
+	t.Run("should authenticate as the given credential", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "second", r.PostFormValue("client_id"))
+			assert.Equal(t, "second secret", r.PostFormValue("client_secret"))
+			w.WriteHeader(AuthApiSuccessStatus)
+		}))
+		defer server.Close()
+		api := NewHttpSoundcloudApi(Config{BaseAuthUrl: server.URL, ClientId: "first"}, clockLib.NewRealClock())
+		_, err := api.ForCredential(Credential{ClientId: "second", ClientSecret: "second secret"}).Auth()
+		assert.NoError(t, err)
+	})
+
+	t.Run("should pick up the rotated secret of the credential", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "rotated", r.PostFormValue("client_secret"))
+			w.WriteHeader(AuthApiSuccessStatus)
+		}))
+		defer server.Close()
+		credentials := []Credential{{Name: "main", ClientId: "id", ClientSecret: "old"}}
+		api := NewHttpSoundcloudApi(Config{BaseAuthUrl: server.URL, ClientCredentials: credentials}, clockLib.NewRealClock())
+		credentialApi := api.ForCredential(credentials[0])
+		api.Reload(Config{ClientCredentials: []Credential{{Name: "main", ClientId: "id", ClientSecret: "rotated"}}})
+		_, err := credentialApi.Auth()
+		assert.NoError(t, err)
+	})
+
+	t.Run("should not pause all traffic when the pool handles a rate limit", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer server.Close()
+		api := NewHttpSoundcloudApi(Config{BaseApiUrl: server.URL}, newMockClock())
+		pool, _ := newCredentialPoolForTest(newMockCredentialApi("a", "b"), "a", "b")
+		api.SetCredentialObserver(pool)
+		token, _ := pool.GetToken()
+		_, err := api.GetTrackData(token, 1)
+		assert.Error(t, err)
+		assert.LessOrEqual(t, api.Limiter().PausedFor(), time.Duration(0))
+		next, _ := pool.GetToken()
+		assert.Equal(t, "b", next.AccessToken)
+		next, _ = pool.GetToken()
+		assert.Equal(t, "b", next.AccessToken)
+	})
+
+	t.Run("should not retry with the benched credential and report its own retry-after", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer server.Close()
+		clock := newMockClock()
+		api := NewHttpSoundcloudApi(Config{BaseApiUrl: server.URL, Retry: RetryConfig{MaxAttempts: 3, MaxDelay: time.Minute * 2}}, clock)
+		pool, _ := newCredentialPoolForTest(newMockCredentialApi("a", "b"), "a", "b")
+		api.SetCredentialObserver(pool)
+		token, _ := pool.GetToken()
+		_, err := api.GetTrackData(token, 1)
+		var limited *RateLimitedError
+		assert.True(t, errors.As(err, &limited))
+		assert.Equal(t, time.Minute, limited.RetryAfter())
+		assert.Equal(t, 1, calls)
+		assert.Empty(t, clock.slept)
+	})
 }
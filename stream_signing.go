@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/giorgiovilardo/etnograbber/clock"
+	"github.com/labstack/echo/v4"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type StreamSigningConfig struct {
+	Secret        string        `mapstructure:"secret"`
+	Required      bool          `mapstructure:"required"`
+	DefaultTtl    time.Duration `mapstructure:"default_ttl" validate:"gte=0"`
+	MaxTtl        time.Duration `mapstructure:"max_ttl" validate:"gte=0"`
+	PublicBaseUrl string        `mapstructure:"public_base_url" validate:"omitempty,url"`
+}
+
+// StreamSignature is the hex HMAC-SHA256 of "trackId:exp", exp being a unix
+// timestamp. In PHP: hash_hmac('sha256', "$trackId:$exp", $secret).
+func StreamSignature(secret string, trackId int, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%d:%d", trackId, exp)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignStreamUrl produces a /:trackId/stream url under baseUrl that stays
+// valid until expiresAt.
+func SignStreamUrl(baseUrl string, secret string, trackId int, expiresAt time.Time) string {
+	exp := expiresAt.Unix()
+	return fmt.Sprintf("%s/%d/stream?exp=%d&sig=%s", strings.TrimSuffix(baseUrl, "/"), trackId, exp, StreamSignature(secret, trackId, exp))
+}
+
+type StreamSigner struct {
+	c     atomic.Pointer[StreamSigningConfig]
+	clock clock.Clock
+}
+
+func NewStreamSigner(c StreamSigningConfig, clock clock.Clock) *StreamSigner {
+	s := &StreamSigner{clock: clock}
+	s.c.Store(&c)
+	return s
+}
+
+// Reload swaps the signing settings, rotating the secret included. Turning
+// signing on or off changes the routes and takes a restart.
+func (s *StreamSigner) Reload(c Config) {
+	if (c.StreamSigning.Secret == "") != (s.config().Secret == "") {
+		log.Printf("stream_signing.secret can only be set or cleared with a restart, keeping the running stream_signing")
+		return
+	}
+	next := c.StreamSigning
+	s.c.Store(&next)
+}
+
+func (s *StreamSigner) config() *StreamSigningConfig {
+	return s.c.Load()
+}
+
+func (s *StreamSigner) Verify(trackId int, exp string, sig string) error {
+	expiresAt, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return errors.New(signatureInvalid)
+	}
+	expected := StreamSignature(s.config().Secret, trackId, expiresAt)
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return errors.New(signatureInvalid)
+	}
+	if time.Unix(expiresAt, 0).Before(s.clock.Now()) {
+		return errors.New(signatureExpired)
+	}
+	return nil
+}
+
+// Middleware verifies signed stream requests. Unsigned ones pass only when
+// signatures are not required or the request carries a valid api key.
+func (s *StreamSigner) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			exp, sig := c.QueryParam("exp"), c.QueryParam("sig")
+			if exp == "" && sig == "" {
+				if _, authenticated := c.Get(apiKeyNameContextKey).(string); s.config().Required && !authenticated {
+					return c.JSON(http.StatusForbidden, map[string]string{"error": signatureRequired})
+				}
+				return next(c)
+			}
+
+			trackId, err := strconv.Atoi(c.Param("trackId"))
+			if err != nil {
+				return apiError(c, trackIdNotANumber)
+			}
+			if err := s.Verify(trackId, exp, sig); err != nil {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+			}
+			return next(c)
+		}
+	}
+}
+
+// streamRoutes are the routes serving the audio of a track, which get the
+// stream rate limit and the StreamSigner. The waveform is one of them when
+// drawn from the peaks of the track, as that downloads it.
+func streamRoutes(waveformSource string) map[string]bool {
+	routes := map[string]bool{
+		"/:trackId/stream":                true,
+		"/:trackId/hls/playlist.m3u8":     true,
+		"/:trackId/hls/segments/:segment": true,
+	}
+	if waveformSource == waveformSourcePeaks {
+		routes["/:trackId/waveform"] = true
+	}
+	return routes
+}
+
+// isSignedStreamRequest lets signed requests skip the api key, only on
+// routes where the StreamSigner verifies the signature.
+func isSignedStreamRequest(c echo.Context, routes map[string]bool) bool {
+	return routes[c.Path()] && c.QueryParam("sig") != ""
+}
+
+// SignHandler mints signed stream urls, valid for the ttl query param
+// (a Go duration, capped at MaxTtl) or DefaultTtl.
+func SignHandler(s *StreamSigner) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		trackId, err := strconv.Atoi(c.Param("trackId"))
+		if err != nil {
+			return apiError(c, trackIdNotANumber)
+		}
+
+		config := s.config()
+		ttl := config.DefaultTtl
+		if param := c.QueryParam("ttl"); param != "" {
+			ttl, err = time.ParseDuration(param)
+			if err != nil || ttl <= 0 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": ttlNotADuration})
+			}
+		}
+		if config.MaxTtl > 0 && ttl > config.MaxTtl {
+			ttl = config.MaxTtl
+		}
+
+		baseUrl := config.PublicBaseUrl
+		if baseUrl == "" {
+			baseUrl = fmt.Sprintf("%s://%s", c.Scheme(), c.Request().Host)
+		}
+		expiresAt := s.clock.Now().Add(ttl).Truncate(time.Second)
+
+		return c.JSON(http.StatusOK, map[string]string{
+			"url":        SignStreamUrl(baseUrl, config.Secret, trackId, expiresAt),
+			"expires_at": expiresAt.UTC().Format(time.RFC3339),
+		})
+	}
+}
+
+const (
+	signatureInvalid  = "invalid signature"
+	signatureExpired  = "signature expired"
+	signatureRequired = "signature required"
+	ttlNotADuration   = "ttl not a duration"
+)
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamSignature(t *testing.T) {
+	t.Run("should match the php hash_hmac sha256 of trackId:exp", func(t *testing.T) {
+		// php -r 'echo hash_hmac("sha256", "1234:1629880200", "secret");'
+		assert.Equal(t, "38f3da47a23a380d75cb747a2c99f009a5d8bc4b7b5e44eea6556a33033bfb9d", StreamSignature("secret", 1234, 1629880200))
+		assert.NotEqual(t, StreamSignature("secret", 1234, 1629880200), StreamSignature("secret", 1235, 1629880200))
+		assert.NotEqual(t, StreamSignature("secret", 1234, 1629880200), StreamSignature("other", 1234, 1629880200))
+	})
+
+	t.Run("should build the signed url", func(t *testing.T) {
+		expiresAt := time.Unix(1629880200, 0)
+		got := SignStreamUrl("https://etno.example.com/", "secret", 1234, expiresAt)
+		assert.Equal(t, "https://etno.example.com/1234/stream?exp=1629880200&sig="+StreamSignature("secret", 1234, 1629880200), got)
+	})
+}
+
+func TestStreamSigner_Middleware(t *testing.T) {
+	clock := newMockClock()
+	exp := strconv.FormatInt(clock.Now().Add(time.Hour).Unix(), 10)
+	expired := strconv.FormatInt(clock.Now().Add(-time.Second).Unix(), 10)
+	sig := func(trackId int, exp string) string {
+		e, _ := strconv.ParseInt(exp, 10, 64)
+		return StreamSignature("secret", trackId, e)
+	}
+	request := func(signer *StreamSigner, query string, authenticated bool) *httptest.ResponseRecorder {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/1234/stream?"+query, nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/:trackId/stream")
+		c.SetParamNames("trackId")
+		c.SetParamValues("1234")
+		if authenticated {
+			c.Set(apiKeyNameContextKey, "php")
+		}
+		_ = signer.Middleware()(func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		})(c)
+		return rec
+	}
+
+	t.Run("should accept a valid signature", func(t *testing.T) {
+		signer := NewStreamSigner(StreamSigningConfig{Secret: "secret", Required: true}, clock)
+		assert.Equal(t, http.StatusOK, request(signer, "exp="+exp+"&sig="+sig(1234, exp), false).Code)
+	})
+
+	t.Run("should reject a signature for another track", func(t *testing.T) {
+		signer := NewStreamSigner(StreamSigningConfig{Secret: "secret"}, clock)
+		rec := request(signer, "exp="+exp+"&sig="+sig(4321, exp), false)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Equal(t, `{"error":"invalid signature"}`, strings.Trim(rec.Body.String(), "\n"))
+	})
+
+	t.Run("should reject a tampered expiry", func(t *testing.T) {
+		signer := NewStreamSigner(StreamSigningConfig{Secret: "secret"}, clock)
+		rec := request(signer, "exp=9999999999&sig="+sig(1234, exp), false)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("should reject an expired signature", func(t *testing.T) {
+		signer := NewStreamSigner(StreamSigningConfig{Secret: "secret"}, clock)
+		rec := request(signer, "exp="+expired+"&sig="+sig(1234, expired), false)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Equal(t, `{"error":"signature expired"}`, strings.Trim(rec.Body.String(), "\n"))
+	})
+
+	t.Run("should let unsigned requests through unless required", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, request(NewStreamSigner(StreamSigningConfig{Secret: "secret"}, clock), "", false).Code)
+		rec := request(NewStreamSigner(StreamSigningConfig{Secret: "secret", Required: true}, clock), "", false)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Equal(t, `{"error":"signature required"}`, strings.Trim(rec.Body.String(), "\n"))
+	})
+
+	t.Run("should let unsigned requests with an api key through even if required", func(t *testing.T) {
+		signer := NewStreamSigner(StreamSigningConfig{Secret: "secret", Required: true}, clock)
+		assert.Equal(t, http.StatusOK, request(signer, "", true).Code)
+	})
+
+	t.Run("should verify with the rotated secret after a reload", func(t *testing.T) {
+		signer := NewStreamSigner(StreamSigningConfig{Secret: "secret"}, clock)
+		signer.Reload(Config{StreamSigning: StreamSigningConfig{Secret: "rotated"}})
+		assert.Equal(t, http.StatusForbidden, request(signer, "exp="+exp+"&sig="+sig(1234, exp), false).Code)
+		expiresAt, _ := strconv.ParseInt(exp, 10, 64)
+		assert.Equal(t, http.StatusOK, request(signer, "exp="+exp+"&sig="+StreamSignature("rotated", 1234, expiresAt), false).Code)
+	})
+
+	t.Run("should keep signing when a reload would turn it off", func(t *testing.T) {
+		signer := NewStreamSigner(StreamSigningConfig{Secret: "secret"}, clock)
+		signer.Reload(Config{})
+		assert.Equal(t, http.StatusOK, request(signer, "exp="+exp+"&sig="+sig(1234, exp), false).Code)
+	})
+}
+
+func TestSignHandler(t *testing.T) {
+	clock := newMockClock()
+	setupEcho := func(trackId string, query string) (echo.Context, *httptest.ResponseRecorder) {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/sign/"+trackId+"?"+query, nil)
+		req.Host = "etno.example.com"
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/sign/:trackId")
+		c.SetParamNames("trackId")
+		c.SetParamValues(trackId)
+		return c, rec
+	}
+
+	t.Run("should mint a url that the signer accepts", func(t *testing.T) {
+		signer := NewStreamSigner(StreamSigningConfig{Secret: "secret", DefaultTtl: time.Hour}, clock)
+		c, r := setupEcho("1234", "")
+		if assert.NoError(t, SignHandler(signer)(c)) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			var body map[string]string
+			_ = json.Unmarshal(r.Body.Bytes(), &body)
+			exp := strconv.FormatInt(clock.Now().Add(time.Hour).Unix(), 10)
+			assert.Equal(t, "http://etno.example.com/1234/stream?exp="+exp+"&sig="+StreamSignature("secret", 1234, clock.Now().Add(time.Hour).Unix()), body["url"])
+			assert.Equal(t, "2021-08-25T09:30:00Z", body["expires_at"])
+			assert.NoError(t, signer.Verify(1234, exp, StreamSignature("secret", 1234, clock.Now().Add(time.Hour).Unix())))
+		}
+	})
+
+	t.Run("should honour the ttl param up to max ttl and the public base url", func(t *testing.T) {
+		signer := NewStreamSigner(StreamSigningConfig{Secret: "secret", DefaultTtl: time.Hour, MaxTtl: time.Hour * 2, PublicBaseUrl: "https://cdn.example.com"}, clock)
+		c, r := setupEcho("1234", "ttl=48h")
+		if assert.NoError(t, SignHandler(signer)(c)) {
+			var body map[string]string
+			_ = json.Unmarshal(r.Body.Bytes(), &body)
+			assert.True(t, strings.HasPrefix(body["url"], "https://cdn.example.com/1234/stream?"))
+			assert.Equal(t, "2021-08-25T10:30:00Z", body["expires_at"])
+		}
+	})
+
+	t.Run("should fail on invalid ttl", func(t *testing.T) {
+		signer := NewStreamSigner(StreamSigningConfig{Secret: "secret", DefaultTtl: time.Hour}, clock)
+		c, r := setupEcho("1234", "ttl=forever")
+		if assert.NoError(t, SignHandler(signer)(c)) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+			assert.Equal(t, `{"error":"ttl not a duration"}`, strings.Trim(r.Body.String(), "\n"))
+		}
+	})
+
+	t.Run("should fail if path param is non int castable", func(t *testing.T) {
+		signer := NewStreamSigner(StreamSigningConfig{Secret: "secret"}, clock)
+		c, r := setupEcho("aba", "")
+		if assert.NoError(t, SignHandler(signer)(c)) {
+			assert.Equal(t, http.StatusServiceUnavailable, r.Code)
+		}
+	})
+}
+
+func TestIsSignedStreamRequest(t *testing.T) {
+	clock := newMockClock()
+	paths := map[string]string{
+		"/:trackId/stream":                "/1234/stream",
+		"/:trackId/hls/playlist.m3u8":     "/1234/hls/playlist.m3u8",
+		"/:trackId/hls/segments/:segment": "/1234/hls/segments/0",
+		"/:trackId/waveform":              "/1234/waveform",
+	}
+	setupEcho := func(waveformSource string) *echo.Echo {
+		routes := streamRoutes(waveformSource)
+		signer := NewStreamSigner(StreamSigningConfig{Secret: "secret"}, clock)
+		e := echo.New()
+		e.Use(ApiKeyAuth(NewApiKeys([]ApiKey{{Name: "php", Key: "php-key"}}), clock, func(c echo.Context) bool {
+			return isSignedStreamRequest(c, routes)
+		}))
+		ok := func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		}
+		for path := range paths {
+			if routes[path] {
+				e.GET(path, ok, signer.Middleware())
+			} else {
+				e.GET(path, ok)
+			}
+		}
+		return e
+	}
+
+	for _, source := range []string{waveformSourceSoundcloud, waveformSourcePeaks} {
+		t.Run("should not let a bogus signature through with the "+source+" waveform", func(t *testing.T) {
+			e := setupEcho(source)
+			for _, target := range paths {
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target+"?exp=9999999999&sig=garbage", nil))
+				assert.Contains(t, []int{http.StatusUnauthorized, http.StatusForbidden}, rec.Code, target)
+			}
+		})
+	}
+
+	t.Run("should only cover the waveform when drawn from peaks", func(t *testing.T) {
+		assert.False(t, streamRoutes(waveformSourceSoundcloud)["/:trackId/waveform"])
+		assert.True(t, streamRoutes(waveformSourcePeaks)["/:trackId/waveform"])
+	})
+}
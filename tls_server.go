@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/giorgiovilardo/etnograbber/clock"
+	"golang.org/x/crypto/acme/autocert"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type TlsConfig struct {
+	CertFile         string   `mapstructure:"cert_file" validate:"required_with=KeyFile"`
+	KeyFile          string   `mapstructure:"key_file" validate:"required_with=CertFile"`
+	AutocertDomains  []string `mapstructure:"autocert_domains" validate:"excluded_with=CertFile,dive,hostname"`
+	AutocertEmail    string   `mapstructure:"autocert_email" validate:"omitempty,email"`
+	AutocertCacheDir string   `mapstructure:"autocert_cache_dir"`
+	RedirectAddress  string   `mapstructure:"redirect_address"`
+}
+
+func (c TlsConfig) Enabled() bool {
+	return c.CertFile != "" || len(c.AutocertDomains) > 0
+}
+
+// NewServerTls builds the tls config of the server, with certificates from
+// autocert when domains are set and from cert_file/key_file otherwise. The
+// returned function wraps the plain http handler so it answers the ACME
+// http-01 challenges.
+func NewServerTls(c TlsConfig, clock clock.Clock) (*tls.Config, func(http.Handler) http.Handler, error) {
+	if len(c.AutocertDomains) > 0 {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(c.AutocertDomains...),
+			Cache:      autocert.DirCache(c.AutocertCacheDir),
+			Email:      c.AutocertEmail,
+		}
+		return m.TLSConfig(), m.HTTPHandler, nil
+	}
+
+	certificate, err := newCertificateFile(c.CertFile, c.KeyFile, clock)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: certificate.GetCertificate,
+	}
+	return tlsConfig, func(h http.Handler) http.Handler { return h }, nil
+}
+
+const (
+	redirectTimeout     = time.Second * 10
+	redirectIdleTimeout = time.Minute
+)
+
+// NewRedirectServer serves handler on the plain http address, bounding how
+// long a client may take to send a request or keep an idle connection open.
+func NewRedirectServer(address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: redirectTimeout,
+		ReadTimeout:       redirectTimeout,
+		WriteTimeout:      redirectTimeout,
+		IdleTimeout:       redirectIdleTimeout,
+	}
+}
+
+// HttpsRedirect sends plain http requests to the same url over https on the
+// port of tlsAddress.
+func HttpsRedirect(tlsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddress)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// certificateCheckInterval spaces out the checks for a rotated certificate,
+// handshakes in between get the current one without touching the disk.
+const certificateCheckInterval = time.Second * 5
+
+// certificateFile serves a key pair from disk, loading it again when either
+// file changes so rotated certificates are picked up without a restart.
+type certificateFile struct {
+	certFile  string
+	keyFile   string
+	clock     clock.Clock
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertificateFile(certFile, keyFile string, clock clock.Clock) (*certificateFile, error) {
+	f := &certificateFile{certFile: certFile, keyFile: keyFile, clock: clock, checkedAt: clock.Now()}
+	modTime, err := f.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	if err := f.load(modTime); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *certificateFile) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.clock.Now()
+	if now.Sub(f.checkedAt) < certificateCheckInterval {
+		return f.cert, nil
+	}
+	f.checkedAt = now
+	if modTime, err := f.lastModified(); err == nil && modTime.After(f.modTime) {
+		if err := f.load(modTime); err != nil {
+			// half way through a rotation, retried once the other file changes
+			f.modTime = modTime
+			log.Printf("certificate reload failed, keeping the current one: %v", err)
+		}
+	}
+	return f.cert, nil
+}
+
+func (f *certificateFile) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return err
+	}
+	f.cert = &cert
+	f.modTime = modTime
+	return nil
+}
+
+func (f *certificateFile) lastModified() (time.Time, error) {
+	cert, certErr := os.Stat(f.certFile)
+	key, keyErr := os.Stat(f.keyFile)
+	if err := errors.Join(certErr, keyErr); err != nil {
+		return time.Time{}, err
+	}
+	if key.ModTime().After(cert.ModTime()) {
+		return key.ModTime(), nil
+	}
+	return cert.ModTime(), nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, dir, commonName string, modTime time.Time) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	_ = os.Chtimes(certFile, modTime, modTime)
+	_ = os.Chtimes(keyFile, modTime, modTime)
+	return certFile, keyFile
+}
+
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateFile(t *testing.T) {
+	t.Run("should pick up a rotated certificate", func(t *testing.T) {
+		dir := t.TempDir()
+		now := time.Now()
+		certFile, keyFile := writeTestCertificate(t, dir, "first", now.Add(-time.Minute))
+		clock := newMockClock()
+		f, err := newCertificateFile(certFile, keyFile, clock)
+		assert.NoError(t, err)
+		cert, _ := f.GetCertificate(nil)
+		assert.Equal(t, "first", commonName(t, cert))
+
+		writeTestCertificate(t, dir, "second", now)
+		clock.Sleep(certificateCheckInterval)
+		cert, _ = f.GetCertificate(nil)
+		assert.Equal(t, "second", commonName(t, cert))
+	})
+
+	t.Run("should check for a rotated certificate only every few seconds", func(t *testing.T) {
+		dir := t.TempDir()
+		now := time.Now()
+		certFile, keyFile := writeTestCertificate(t, dir, "first", now.Add(-time.Minute))
+		clock := newMockClock()
+		f, _ := newCertificateFile(certFile, keyFile, clock)
+
+		writeTestCertificate(t, dir, "second", now)
+		clock.Sleep(certificateCheckInterval - time.Second)
+		cert, _ := f.GetCertificate(nil)
+		assert.Equal(t, "first", commonName(t, cert))
+		clock.Sleep(time.Second)
+		cert, _ = f.GetCertificate(nil)
+		assert.Equal(t, "second", commonName(t, cert))
+	})
+
+	t.Run("should keep the current certificate when the new one is broken", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile := writeTestCertificate(t, dir, "first", time.Now().Add(-time.Minute))
+		clock := newMockClock()
+		f, _ := newCertificateFile(certFile, keyFile, clock)
+		_ = os.WriteFile(certFile, []byte("garbage"), 0600)
+		clock.Sleep(certificateCheckInterval)
+		cert, err := f.GetCertificate(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "first", commonName(t, cert))
+	})
+
+	t.Run("should fail on missing files", func(t *testing.T) {
+		_, err := newCertificateFile("nope.pem", "nope.key", newMockClock())
+		assert.Error(t, err)
+	})
+}
+
+func TestHttpsRedirect(t *testing.T) {
+	redirect := func(tlsAddress, target string) string {
+		rec := httptest.NewRecorder()
+		HttpsRedirect(tlsAddress).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+		return rec.Header().Get("Location")
+	}
+
+	t.Run("should redirect to the default https port", func(t *testing.T) {
+		assert.Equal(t, "https://etnoteam.it/1234/stream?sig=abc", redirect(":443", "http://etnoteam.it:80/1234/stream?sig=abc"))
+	})
+
+	t.Run("should redirect to a custom https port", func(t *testing.T) {
+		assert.Equal(t, "https://etnoteam.it:8443/health", redirect(":8443", "http://etnoteam.it/health"))
+	})
+
+	t.Run("should not let slow or idle clients hold connections", func(t *testing.T) {
+		server := NewRedirectServer(":80", HttpsRedirect(":443"))
+		assert.Equal(t, redirectTimeout, server.ReadHeaderTimeout)
+		assert.Equal(t, redirectIdleTimeout, server.IdleTimeout)
+	})
+}
+
+func TestNewServerTls(t *testing.T) {
+	t.Run("should serve http/2 over tls", func(t *testing.T) {
+		certFile, keyFile := writeTestCertificate(t, t.TempDir(), "etnograbber", time.Now())
+		tlsConfig, _, err := NewServerTls(TlsConfig{CertFile: certFile, KeyFile: keyFile}, newMockClock())
+		assert.NoError(t, err)
+
+		e := echo.New()
+		e.HideBanner = true
+		e.HidePort = true
+		e.GET("/health", HealthHandler)
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		e.TLSListener = tls.NewListener(listener, tlsConfig)
+		e.TLSServer.TLSConfig = tlsConfig
+		go func() { _ = e.StartServer(e.TLSServer) }()
+		defer e.Close()
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		res, err := client.Get("https://" + listener.Addr().String() + "/health")
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, 2, res.ProtoMajor)
+	})
+
+	t.Run("should answer acme challenges when using autocert", func(t *testing.T) {
+		tlsConfig, acmeChallenges, err := NewServerTls(TlsConfig{AutocertDomains: []string{"etnoteam.it"}, AutocertCacheDir: t.TempDir()}, newMockClock())
+		assert.NoError(t, err)
+		assert.Contains(t, tlsConfig.NextProtos, "acme-tls/1")
+		rec := httptest.NewRecorder()
+		acmeChallenges(HttpsRedirect(":443")).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://etnoteam.it/.well-known/acme-challenge/token", nil))
+		assert.NotEqual(t, http.StatusMovedPermanently, rec.Code)
+	})
+}
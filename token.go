@@ -9,25 +9,42 @@ import (
 
 type Token struct {
 	AccessToken  string `json:"access_token" validate:"required"`
-	ExpiresIn    int    `json:"expires_in" validate:"required"`
+	ExpiresIn    int    `json:"expires_in" validate:"required,gt=0"`
 	RefreshToken string `json:"refresh_token" validate:"required"`
 	Scope        string `json:"scope" validate:"eq="`
 	TokenType    string `json:"token_type" validate:"required,eq=bearer"`
-	ExpiresAt    time.Time
+	// Source tells who issued the token, soundcloud or the fallback
+	Source    string    `json:"source,omitempty"`
+	ExpiresAt time.Time `json:"-"`
 }
 
 func (t Token) IsExpired(c clock.Clock) bool {
 	return t.ExpiresAt.Before(c.Now())
 }
 
+// NewTokenFromJsonData parses a token as SoundCloud or getFallback hand it
+// over. Fallback tokens come without a refresh token, as they are replaced
+// instead of renewed.
 func NewTokenFromJsonData(tokenData []byte, now time.Time) (Token, error) {
+	t, err := parseToken(tokenData, now, "RefreshToken")
+	if err != nil || t.Source == tokenSourceFallback {
+		return t, err
+	}
+	if err := validator.New().StructPartial(t, "RefreshToken"); err != nil {
+		return Token{}, err
+	}
+	return t, nil
+}
+
+// parseToken validates every field of the token but the optional ones.
+func parseToken(tokenData []byte, now time.Time, optional ...string) (Token, error) {
 	var t Token
 	if err := json.Unmarshal(tokenData, &t); err != nil {
 		return Token{}, err
 	}
 	t.ExpiresAt = now.Add(time.Second * time.Duration(t.ExpiresIn))
 	validate := validator.New()
-	if err := validate.Struct(t); err != nil {
+	if err := validate.StructExcept(t, optional...); err != nil {
 		return Token{}, err
 	}
 	return t, nil
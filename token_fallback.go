@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/giorgiovilardo/etnograbber/clock"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	tokenSourceSoundcloud = "soundcloud"
+	tokenSourceFallback   = "fallback"
+	tokenExportPath       = "/token-export"
+)
+
+type TokenFallbackConfig struct {
+	AuthHeader     string        `mapstructure:"auth_header"`
+	ClientCertFile string        `mapstructure:"client_cert_file" validate:"required_with=ClientKeyFile,omitempty,file"`
+	ClientKeyFile  string        `mapstructure:"client_key_file" validate:"required_with=ClientCertFile,omitempty,file"`
+	CaFile         string        `mapstructure:"ca_file" validate:"omitempty,file"`
+	MinTtl         time.Duration `mapstructure:"min_ttl" validate:"gte=0"`
+}
+
+type TokenExportConfig struct {
+	Key string `mapstructure:"key"`
+}
+
+// newFallbackClient returns client unless the fallback needs mTLS or a
+// private CA, in which case it gets a transport of its own. The client
+// certificate is read again when it changes on disk.
+func newFallbackClient(c TokenFallbackConfig, upstream UpstreamHttpConfig, client *http.Client, clock clock.Clock) (*http.Client, error) {
+	if c.ClientCertFile == "" && c.CaFile == "" {
+		return client, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.ClientCertFile != "" {
+		certificate, err := newCertificateFile(c.ClientCertFile, c.ClientKeyFile, clock)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certificate.GetCertificate(nil)
+		}
+	}
+	if c.CaFile != "" {
+		ca, err := os.ReadFile(c.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %s", c.CaFile)
+		}
+	}
+
+	transport := NewUpstreamTransport(upstream)
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, CheckRedirect: client.CheckRedirect}, nil
+}
+
+// validateFallbackToken checks what the fallback answered is a usable token,
+// valid for at least minTtl, and marks it as coming from the fallback. Its
+// refresh token, if any, is never used.
+func validateFallbackToken(body []byte, now time.Time, minTtl time.Duration) (Token, error) {
+	t, err := parseToken(body, now, "RefreshToken")
+	if err != nil {
+		return Token{}, errors.Join(errors.New("fallback answered an invalid token"), err)
+	}
+	if time.Duration(t.ExpiresIn)*time.Second < minTtl {
+		return Token{}, fmt.Errorf("fallback token expires in %ds, less than %s", t.ExpiresIn, minTtl)
+	}
+	t.Source = tokenSourceFallback
+	return t, nil
+}
+
+// TokenExportAuth requires the export key as a bearer token.
+func TokenExportAuth(key string) echo.MiddlewareFunc {
+	expected := []byte("Bearer " + key)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			provided := []byte(c.Request().Header.Get(echo.HeaderAuthorization))
+			if subtle.ConstantTimeCompare(provided, expected) != 1 {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid token export key"})
+			}
+			return next(c)
+		}
+	}
+}
+
+func isTokenExportRequest(c echo.Context) bool {
+	return c.Path() == tokenExportPath
+}
+
+// TokenExportHandler answers with the current token in the shape the
+// token_generator_fallback of another instance expects, leaving out the
+// refresh token that only this instance may use.
+func TokenExportHandler(tr TokenRepository, clock clock.Clock) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		t, err := tr.GetToken()
+		if err != nil {
+			return apiServiceError(c, newServiceError("token not available", err))
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"access_token": t.AccessToken,
+			"expires_in":   int(t.ExpiresAt.Sub(clock.Now()).Seconds()),
+			"scope":        t.Scope,
+			"token_type":   t.TokenType,
+			"source":       t.Source,
+		})
+	}
+}
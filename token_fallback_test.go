@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const fallbackTokenJson = `{"access_token":"miao","expires_in":3599,"refresh_token":"bau","scope":"","token_type":"bearer"}`
+
+func TestValidateFallbackToken(t *testing.T) {
+	now := newMockClock().Now()
+
+	t.Run("should accept a well formed token and mark its source", func(t *testing.T) {
+		token, err := validateFallbackToken([]byte(fallbackTokenJson), now, time.Minute)
+		assert.NoError(t, err)
+		assert.Equal(t, "miao", token.AccessToken)
+		assert.Equal(t, tokenSourceFallback, token.Source)
+		assert.Equal(t, now.Add(time.Second*3599), token.ExpiresAt)
+	})
+
+	t.Run("should reject anything that is not a token", func(t *testing.T) {
+		for _, body := range []string{`{"ola":"ola"}`, `<html>oops</html>`, `{"access_token":"miao","expires_in":3599,"refresh_token":"bau","token_type":"mac"}`} {
+			_, err := validateFallbackToken([]byte(body), now, time.Minute)
+			assert.ErrorContains(t, err, "fallback answered an invalid token", body)
+		}
+	})
+
+	t.Run("should reject expired or soon expiring tokens", func(t *testing.T) {
+		_, err := validateFallbackToken([]byte(`{"access_token":"miao","expires_in":-10,"refresh_token":"bau","scope":"","token_type":"bearer"}`), now, time.Minute)
+		assert.Error(t, err)
+		_, err = validateFallbackToken([]byte(`{"access_token":"miao","expires_in":30,"refresh_token":"bau","scope":"","token_type":"bearer"}`), now, time.Minute)
+		assert.ErrorContains(t, err, "fallback token expires in 30s")
+	})
+}
+
+func TestHttpSoundcloudApi_Fallback(t *testing.T) {
+	t.Run("should send the configured auth header", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "Bearer sekret", r.Header.Get("Authorization"))
+			_, _ = w.Write([]byte(fallbackTokenJson))
+		}))
+		defer server.Close()
+		conf := Config{BaseAuthUrl: "bad server", FallbackAuthUrl: server.URL, TokenFallback: TokenFallbackConfig{AuthHeader: "Bearer sekret"}}
+		_, err := NewHttpSoundcloudApi(conf, newMockClock()).Auth()
+		assert.NoError(t, err)
+	})
+
+	t.Run("should authenticate with a client certificate", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile := writeTestCertificate(t, dir, "etnograbber", time.Now())
+		certPem, _ := os.ReadFile(certFile)
+		block, _ := pem.Decode(certPem)
+		clientCert, _ := x509.ParseCertificate(block.Bytes)
+		clients := x509.NewCertPool()
+		clients.AddCert(clientCert)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "etnograbber", r.TLS.PeerCertificates[0].Subject.CommonName)
+			_, _ = w.Write([]byte(fallbackTokenJson))
+		}))
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clients}
+		server.StartTLS()
+		defer server.Close()
+		caFile := filepath.Join(dir, "ca.pem")
+		_ = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+		conf := Config{BaseAuthUrl: "bad server", FallbackAuthUrl: server.URL, TokenFallback: TokenFallbackConfig{
+			ClientCertFile: certFile, ClientKeyFile: keyFile, CaFile: caFile,
+		}}
+		res, err := NewHttpSoundcloudApi(conf, newMockClock()).Auth()
+		assert.NoError(t, err)
+		assert.Contains(t, string(res), `"source":"fallback"`)
+
+		conf.TokenFallback = TokenFallbackConfig{CaFile: caFile}
+		_, err = NewHttpSoundcloudApi(conf, newMockClock()).Auth()
+		assert.ErrorContains(t, err, "impossible to acquire a token")
+	})
+
+	t.Run("should refuse an invalid payload", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`<html>maintenance</html>`))
+		}))
+		defer server.Close()
+		conf := Config{BaseAuthUrl: "bad server", FallbackAuthUrl: server.URL}
+		_, err := NewHttpSoundcloudApi(conf, newMockClock()).Auth()
+		assert.ErrorContains(t, err, "fallback answered an invalid token")
+	})
+}
+
+func TestTokenExport(t *testing.T) {
+	clock := newMockClock()
+	export := func(authorization string, tr TokenRepository) *httptest.ResponseRecorder {
+		e := echo.New()
+		e.GET(tokenExportPath, TokenExportHandler(tr, clock), TokenExportAuth("sekret"))
+		req := httptest.NewRequest(http.MethodGet, tokenExportPath, nil)
+		req.Header.Set("Authorization", authorization)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	tokens := mockTokenSource(func() (Token, error) {
+		return Token{AccessToken: "miao", RefreshToken: "bau", TokenType: "bearer", Source: tokenSourceSoundcloud, ExpiresAt: clock.Now().Add(time.Minute * 30)}, nil
+	})
+
+	t.Run("should export the current token in the fallback shape, without the refresh token", func(t *testing.T) {
+		rec := export("Bearer sekret", tokens)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"access_token":"miao","expires_in":1800,"scope":"","token_type":"bearer","source":"soundcloud"}`, rec.Body.String())
+		_, err := validateFallbackToken(rec.Body.Bytes(), clock.Now(), time.Minute)
+		assert.NoError(t, err)
+	})
+
+	t.Run("should require the export key", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, export("", tokens).Code)
+		assert.Equal(t, http.StatusUnauthorized, export("Bearer nope", tokens).Code)
+	})
+
+	t.Run("should be usable as the fallback of another instance", func(t *testing.T) {
+		e := echo.New()
+		e.GET(tokenExportPath, TokenExportHandler(tokens, clock), TokenExportAuth("sekret"))
+		server := httptest.NewServer(e)
+		defer server.Close()
+		conf := Config{
+			BaseAuthUrl:     "not a server",
+			FallbackAuthUrl: server.URL + tokenExportPath,
+			TokenFallback:   TokenFallbackConfig{AuthHeader: "Bearer sekret", MinTtl: time.Minute},
+		}
+		repo := NewHttpTokenRepository(clock, NewHttpSoundcloudApi(conf, clock))
+		got, err := repo.GetToken()
+		assert.NoError(t, err)
+		assert.Equal(t, "miao", got.AccessToken)
+		assert.Equal(t, "", got.RefreshToken)
+		assert.Equal(t, tokenSourceFallback, got.Source)
+		assert.Equal(t, clock.Now().Add(time.Minute*30), got.ExpiresAt)
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/giorgiovilardo/etnograbber/clock"
+	"log"
 	"sync"
 	"time"
 )
@@ -37,6 +38,9 @@ func (s *HttpTokenRepository) GetToken() (Token, error) {
 	if s.currentToken.IsExpired(s.clock) {
 		token, err := renewToken(s.currentToken, s.sc, s.clock.Now())
 		if err != nil {
+			// the next call starts over instead of renewing a dead token
+			s.initialized = false
+			s.currentToken = Token{}
 			return Token{}, err
 		}
 
@@ -45,6 +49,20 @@ func (s *HttpTokenRepository) GetToken() (Token, error) {
 	return s.currentToken, nil
 }
 
+func (s *HttpTokenRepository) PeekToken() Token {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	return s.currentToken
+}
+
+// Invalidate drops the current token, the next GetToken asks for a new one.
+func (s *HttpTokenRepository) Invalidate() {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.initialized = false
+	s.currentToken = Token{}
+}
+
 func newToken(sc SoundcloudApi, now time.Time) (Token, error) {
 	tokenData, err := sc.Auth()
 	if err != nil {
@@ -55,11 +73,22 @@ func newToken(sc SoundcloudApi, now time.Time) (Token, error) {
 	if err != nil {
 		return Token{}, err
 	}
+	if t.Source == "" {
+		t.Source = tokenSourceSoundcloud
+	}
+	log.Printf("new token issued by %s", t.Source)
 
 	return t, nil
 }
 
+// renewToken refreshes a SoundCloud token. A fallback token is replaced with
+// a new one instead: its refresh token belongs to another client and may be
+// single use for the instance that exported it.
 func renewToken(t Token, sc SoundcloudApi, now time.Time) (Token, error) {
+	if t.Source == tokenSourceFallback {
+		return newToken(sc, now)
+	}
+
 	renewData, err := sc.Renew(t)
 	if err != nil {
 		return Token{}, err
@@ -69,6 +98,7 @@ func renewToken(t Token, sc SoundcloudApi, now time.Time) (Token, error) {
 	if err != nil {
 		return Token{}, err
 	}
+	newTok.Source = t.Source
 
 	return newTok, nil
 }
@@ -115,3 +115,55 @@ func (m *mockSoundcloudApi) Renew(_ Token) ([]byte, error) {
 	}
 	return []byte(`{"access_token":"miao_renewed","expires_in":3599,"refresh_token":"bau","scope":"","token_type":"bearer"}`), nil
 }
+
+func TestHttpTokenRepository_Source(t *testing.T) {
+	clock := clockLib.NewBrokenClock(time.Date(2021, 8, 25, 8, 30, 0, 0, time.UTC))
+
+	t.Run("should record soundcloud as the source unless the fallback issued the token", func(t *testing.T) {
+		got, _ := NewHttpTokenRepository(clock, &mockSoundcloudApi{}).GetToken()
+		assert.Equal(t, tokenSourceSoundcloud, got.Source)
+		withSource := []byte(`{"access_token":"miao","expires_in":3599,"refresh_token":"bau","scope":"","token_type":"bearer","source":"fallback"}`)
+		got, _ = NewHttpTokenRepository(clock, &mockSoundcloudApi{thatReturns: withSource}).GetToken()
+		assert.Equal(t, tokenSourceFallback, got.Source)
+	})
+
+	t.Run("should ask for a new token when a fallback token expires", func(t *testing.T) {
+		api := &mockSoundcloudApi{}
+		repo := &HttpTokenRepository{
+			currentToken: Token{AccessToken: "exported", RefreshToken: "not ours", Source: tokenSourceFallback, ExpiresAt: time.Date(1999, 1, 1, 1, 1, 1, 1, time.UTC)},
+			sc:           api,
+			initialized:  true,
+			clock:        clock,
+		}
+		got, err := repo.GetToken()
+		assert.NoError(t, err)
+		assert.Equal(t, "miao", got.AccessToken)
+		assert.Equal(t, tokenSourceSoundcloud, got.Source)
+		assert.Equal(t, 1, api.Calls)
+	})
+
+	t.Run("should start over after a failed renewal", func(t *testing.T) {
+		api := &mockSoundcloudApi{wantErr: true, errMsg: "renew_fail"}
+		repo := &HttpTokenRepository{
+			currentToken: Token{AccessToken: "old", Source: tokenSourceSoundcloud, ExpiresAt: time.Date(1999, 1, 1, 1, 1, 1, 1, time.UTC)},
+			sc:           api,
+			initialized:  true,
+			clock:        clock,
+		}
+		_, err := repo.GetToken()
+		assert.EqualError(t, err, "renew_fail")
+		api.wantErr = false
+		got, err := repo.GetToken()
+		assert.NoError(t, err)
+		assert.Equal(t, "miao", got.AccessToken)
+	})
+
+	t.Run("should ask for a new token once invalidated", func(t *testing.T) {
+		api := &mockSoundcloudApi{}
+		repo := NewHttpTokenRepository(clock, api)
+		_, _ = repo.GetToken()
+		repo.Invalidate()
+		_, _ = repo.GetToken()
+		assert.Equal(t, 2, api.Calls)
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/giorgiovilardo/etnograbber/clock"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type TokenStoreConfig struct {
+	Backend         string        `mapstructure:"backend" validate:"omitempty,oneof=file redis"`
+	Path            string        `mapstructure:"path" validate:"required_if=Backend file"`
+	RedisUrl        string        `mapstructure:"redis_url" validate:"required_if=Backend redis"`
+	RedisPrefix     string        `mapstructure:"redis_prefix"`
+	LeaseTtl        time.Duration `mapstructure:"lease_ttl" validate:"gt=0"`
+	RefreshInterval time.Duration `mapstructure:"refresh_interval" validate:"gt=0,ltfield=LeaseTtl"`
+	RenewBefore     time.Duration `mapstructure:"renew_before" validate:"gte=0"`
+}
+
+var errNotLeader = errors.New("token not available yet, waiting for the leader to renew it")
+
+// storedToken is a Token as kept in a store, with the expiry that is not
+// part of the SoundCloud payload.
+type storedToken struct {
+	Token
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func marshalStoredToken(t Token) ([]byte, error) {
+	return json.Marshal(storedToken{Token: t, ExpiresAt: t.ExpiresAt})
+}
+
+func unmarshalStoredToken(data []byte) (Token, error) {
+	var s storedToken
+	if err := json.Unmarshal(data, &s); err != nil {
+		return Token{}, err
+	}
+	t := s.Token
+	t.ExpiresAt = s.ExpiresAt
+	return t, nil
+}
+
+// SharedTokenRepository hands out the token kept in a TokenStore. The replica
+// holding the lease keeps it fresh, renewing it renewBefore its expiry; the
+// others only read it and never ask SoundCloud for a token themselves.
+type SharedTokenRepository struct {
+	store    TokenStore
+	key      string
+	holder   string
+	sc       SoundcloudApi
+	clock    clock.Clock
+	c        TokenStoreConfig
+	mu       sync.Mutex
+	current  Token
+	rejected string
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewSharedTokenRepository(store TokenStore, key string, sc SoundcloudApi, clock clock.Clock, c TokenStoreConfig) *SharedTokenRepository {
+	return &SharedTokenRepository{store: store, key: key, holder: tokenStoreHolder(), sc: sc, clock: clock, c: c}
+}
+
+func (r *SharedTokenRepository) GetToken() (Token, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.usable(r.current) {
+		return r.current, nil
+	}
+	if t, err := r.load(); err != nil || r.usable(t) {
+		return t, err
+	}
+
+	lead, err := r.store.TryLead(r.key, r.holder, r.c.LeaseTtl)
+	if err != nil {
+		return Token{}, err
+	}
+	if !lead {
+		return Token{}, errNotLeader
+	}
+	return r.renew()
+}
+
+func (r *SharedTokenRepository) PeekToken() Token {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Invalidate drops a token SoundCloud rejected and records the rejection in
+// the store, where the leader sees it on its next refresh and gets a new one.
+func (r *SharedTokenRepository) Invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current.AccessToken == "" {
+		return
+	}
+	r.rejected = r.current.AccessToken
+	r.current = Token{}
+	if err := r.store.Reject(r.key, r.rejected); err != nil {
+		log.Printf("token store: %v", err)
+	}
+}
+
+// Start keeps trying to lead and, while leading, renews the token before it
+// expires, until Stop.
+func (r *SharedTokenRepository) Start() {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.c.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			r.refresh()
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop ends the refresh loop and gives up the lease so another replica can
+// take over right away.
+func (r *SharedTokenRepository) Stop(ctx context.Context) error {
+	if r.stop != nil {
+		close(r.stop)
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return r.store.Release(r.key, r.holder)
+}
+
+func (r *SharedTokenRepository) refresh() {
+	lead, err := r.store.TryLead(r.key, r.holder, r.c.LeaseTtl)
+	if err != nil {
+		log.Printf("token store: %v", err)
+		return
+	}
+	if !lead {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, err := r.load()
+	if err != nil {
+		log.Printf("token store: %v", err)
+		return
+	}
+	if r.usable(t) && t.ExpiresAt.Sub(r.clock.Now()) > r.c.RenewBefore {
+		return
+	}
+	if _, err := r.renew(); err != nil {
+		log.Printf("token renewal failed: %v", err)
+	}
+}
+
+// load reads the stored token into current, it has to be called holding mu.
+func (r *SharedTokenRepository) load() (Token, error) {
+	t, ok, err := r.store.Load(r.key)
+	if err != nil || !ok {
+		return Token{}, err
+	}
+	if r.usable(t) {
+		r.current = t
+	}
+	return t, nil
+}
+
+// renew refreshes the stored token, or asks for a new one when there is
+// none or it was rejected. It has to be called holding mu and the lease.
+func (r *SharedTokenRepository) renew() (Token, error) {
+	stored, ok, err := r.store.Load(r.key)
+	if err != nil {
+		return Token{}, err
+	}
+	var t Token
+	if ok && stored.AccessToken != r.rejected && stored.RefreshToken != "" {
+		t, err = renewToken(stored, r.sc, r.clock.Now())
+	} else {
+		t, err = newToken(r.sc, r.clock.Now())
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	if err := r.store.Save(r.key, t); err != nil {
+		return Token{}, err
+	}
+	r.current = t
+	return t, nil
+}
+
+func (r *SharedTokenRepository) usable(t Token) bool {
+	return t.AccessToken != "" && t.AccessToken != r.rejected && !t.IsExpired(r.clock)
+}
+
+// tokenStoreHolder names this replica in leases, unique even for several
+// processes on one host.
+func tokenStoreHolder() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// NewTokenStore returns the store of the configured backend, nil when tokens
+// are kept in the process.
+func NewTokenStore(c TokenStoreConfig) (TokenStore, error) {
+	switch c.Backend {
+	case "file":
+		return NewFileTokenStore(c.Path)
+	case "redis":
+		client, err := NewRedisClient(c.RedisUrl)
+		if err != nil {
+			return nil, err
+		}
+		return NewRedisTokenStore(client, c.RedisPrefix), nil
+	}
+	return nil, nil
+}
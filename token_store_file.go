@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileTokenStore keeps tokens in a directory shared by the replicas, the
+// lease on a key being an exclusive lock on its lock file. The lock goes
+// away with the process holding it, so the ttl is not needed.
+type FileTokenStore struct {
+	dir   string
+	mu    sync.Mutex
+	locks map[string]*os.File
+}
+
+func NewFileTokenStore(dir string) (*FileTokenStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileTokenStore{dir: dir, locks: make(map[string]*os.File)}, nil
+}
+
+func (s *FileTokenStore) Load(key string) (Token, bool, error) {
+	data, err := os.ReadFile(s.path(key, ".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return Token{}, false, nil
+	}
+	if err != nil {
+		return Token{}, false, err
+	}
+	t, err := unmarshalStoredToken(data)
+	if err != nil {
+		return Token{}, false, err
+	}
+	rejected, err := os.ReadFile(s.path(key, ".rejected"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Token{}, false, err
+	}
+	if string(rejected) == t.AccessToken {
+		return Token{}, false, nil
+	}
+	return t, true, nil
+}
+
+func (s *FileTokenStore) Save(key string, t Token) error {
+	data, err := marshalStoredToken(t)
+	if err != nil {
+		return err
+	}
+	return s.write(s.path(key, ".json"), data)
+}
+
+func (s *FileTokenStore) Reject(key, accessToken string) error {
+	return s.write(s.path(key, ".rejected"), []byte(accessToken))
+}
+
+// write puts data next to path and renames it, so readers never see it half
+// written.
+func (s *FileTokenStore) write(path string, data []byte) error {
+	f, err := os.CreateTemp(s.dir, ".token-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err = errors.Join(err, f.Close()); err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *FileTokenStore) TryLead(key, _ string, _ time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.locks[key]; ok {
+		return true, nil
+	}
+
+	f, err := os.OpenFile(s.path(key, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return false, err
+	}
+	locked, err := tryLockFile(f)
+	if !locked {
+		_ = f.Close()
+		return false, err
+	}
+	s.locks[key] = f
+	return true, nil
+}
+
+func (s *FileTokenStore) Release(key, _ string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.locks[key]
+	if !ok {
+		return nil
+	}
+	delete(s.locks, key)
+	return errors.Join(unlockFile(f), f.Close())
+}
+
+func (s *FileTokenStore) path(key, ext string) string {
+	return filepath.Join(s.dir, url.PathEscape(key)+ext)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+const redisTimeout = time.Second * 5
+
+// leaseScript extends the lease of its holder or takes a free one.
+var leaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0`)
+
+// releaseScript drops the lease only if it is still held by its holder.
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// RedisTokenStore keeps tokens under prefix+key, the last rejected access
+// token under prefix+key+":rejected" and the leases under prefix+key+":lease",
+// expiring after their ttl unless extended.
+type RedisTokenStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisTokenStore(client *redis.Client, prefix string) *RedisTokenStore {
+	return &RedisTokenStore{client: client, prefix: prefix}
+}
+
+func (s *RedisTokenStore) Load(key string) (Token, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	values, err := s.client.MGet(ctx, s.prefix+key, s.prefix+key+":rejected").Result()
+	if err != nil {
+		return Token{}, false, err
+	}
+	data, ok := values[0].(string)
+	if !ok {
+		return Token{}, false, nil
+	}
+	t, err := unmarshalStoredToken([]byte(data))
+	if err != nil {
+		return Token{}, false, err
+	}
+	if rejected, _ := values[1].(string); rejected == t.AccessToken {
+		return Token{}, false, nil
+	}
+	return t, true, nil
+}
+
+func (s *RedisTokenStore) Save(key string, t Token) error {
+	data, err := marshalStoredToken(t)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return s.client.Set(ctx, s.prefix+key, data, 0).Err()
+}
+
+func (s *RedisTokenStore) Reject(key, accessToken string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return s.client.Set(ctx, s.prefix+key+":rejected", accessToken, 0).Err()
+}
+
+func (s *RedisTokenStore) TryLead(key, holder string, ttl time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	held, err := leaseScript.Run(ctx, s.client, []string{s.prefix + key + ":lease"}, holder, ttl.Milliseconds()).Int()
+	return held == 1, err
+}
+
+func (s *RedisTokenStore) Release(key, holder string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return releaseScript.Run(ctx, s.client, []string{s.prefix + key + ":lease"}, holder).Err()
+}
+
+// Ping reports whether redis answers, for the readiness check.
+func (s *RedisTokenStore) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return s.client.Ping(ctx).Err()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var testTokenStoreConfig = TokenStoreConfig{LeaseTtl: time.Second * 30, RefreshInterval: time.Second * 10, RenewBefore: time.Minute * 5}
+
+func TestSharedTokenRepository(t *testing.T) {
+	newReplicas := func(t *testing.T) (*SharedTokenRepository, *mockSoundcloudApi, *SharedTokenRepository, *mockSoundcloudApi, *mockClock) {
+		dir := t.TempDir()
+		clock := newMockClock()
+		replica := func() (*SharedTokenRepository, *mockSoundcloudApi) {
+			store, err := NewFileTokenStore(dir)
+			assert.NoError(t, err)
+			api := &mockSoundcloudApi{}
+			return NewSharedTokenRepository(store, "default", api, clock, testTokenStoreConfig), api
+		}
+		leader, leaderApi := replica()
+		follower, followerApi := replica()
+		return leader, leaderApi, follower, followerApi, clock
+	}
+
+	t.Run("should let only the leader ask for a token, followers read it", func(t *testing.T) {
+		leader, leaderApi, follower, followerApi, _ := newReplicas(t)
+		_, err := leader.GetToken()
+		assert.NoError(t, err)
+		got, err := follower.GetToken()
+		assert.NoError(t, err)
+		assert.Equal(t, "miao", got.AccessToken)
+		assert.Equal(t, 1, leaderApi.Calls)
+		assert.Equal(t, 0, followerApi.Calls)
+	})
+
+	t.Run("should make followers wait for the leader when there is no token", func(t *testing.T) {
+		leader, _, follower, followerApi, _ := newReplicas(t)
+		leader.store.TryLead(leader.key, leader.holder, time.Minute)
+		_, err := follower.GetToken()
+		assert.ErrorIs(t, err, errNotLeader)
+		assert.Equal(t, 0, followerApi.Calls)
+	})
+
+	t.Run("should renew the token before it expires, while leading", func(t *testing.T) {
+		leader, leaderApi, follower, followerApi, clock := newReplicas(t)
+		leader.refresh()
+		follower.refresh()
+		clock.Sleep(time.Minute * 56)
+		leader.refresh()
+		follower.refresh()
+		assert.Equal(t, 2, leaderApi.Calls)
+		assert.Equal(t, 0, followerApi.Calls)
+		clock.Sleep(time.Minute * 4)
+		got, err := follower.GetToken()
+		assert.NoError(t, err)
+		assert.Equal(t, "miao_renewed", got.AccessToken)
+	})
+
+	t.Run("should hand leadership over once the leader stops", func(t *testing.T) {
+		leader, _, follower, followerApi, clock := newReplicas(t)
+		leader.refresh()
+		assert.NoError(t, leader.Stop(context.Background()))
+		clock.Sleep(time.Hour)
+		follower.refresh()
+		got, err := follower.GetToken()
+		assert.NoError(t, err)
+		assert.Equal(t, "miao_renewed", got.AccessToken)
+		assert.Equal(t, 1, followerApi.Calls)
+	})
+
+	t.Run("should ask for a new token when the current one was rejected", func(t *testing.T) {
+		leader, leaderApi, _, _, _ := newReplicas(t)
+		leader.refresh()
+		leaderApi.thatReturns = []byte(`{"access_token":"woof","expires_in":3599,"refresh_token":"bau","scope":"","token_type":"bearer"}`)
+		leader.Invalidate()
+		got, err := leader.GetToken()
+		assert.NoError(t, err)
+		assert.Equal(t, "woof", got.AccessToken)
+	})
+
+	t.Run("should let the leader replace a token a follower saw rejected", func(t *testing.T) {
+		leader, leaderApi, follower, followerApi, _ := newReplicas(t)
+		leader.refresh()
+		_, err := follower.GetToken()
+		assert.NoError(t, err)
+		follower.Invalidate()
+		_, err = follower.GetToken()
+		assert.ErrorIs(t, err, errNotLeader)
+
+		leaderApi.thatReturns = []byte(`{"access_token":"woof","expires_in":3599,"refresh_token":"bau","scope":"","token_type":"bearer"}`)
+		leader.refresh()
+		got, err := follower.GetToken()
+		assert.NoError(t, err)
+		assert.Equal(t, "woof", got.AccessToken)
+		assert.Equal(t, 2, leaderApi.Calls)
+		assert.Equal(t, 0, followerApi.Calls)
+	})
+}
+
+func TestFileTokenStore(t *testing.T) {
+	t.Run("should keep the token with its expiry", func(t *testing.T) {
+		store, _ := NewFileTokenStore(t.TempDir())
+		_, ok, err := store.Load("default")
+		assert.False(t, ok)
+		assert.NoError(t, err)
+		token := Token{AccessToken: "miao", ExpiresAt: newMockClock().Now(), Source: tokenSourceSoundcloud}
+		assert.NoError(t, store.Save("default", token))
+		got, ok, err := store.Load("default")
+		assert.True(t, ok)
+		assert.NoError(t, err)
+		assert.Equal(t, token.AccessToken, got.AccessToken)
+		assert.True(t, token.ExpiresAt.Equal(got.ExpiresAt))
+	})
+
+	t.Run("should not load a rejected token", func(t *testing.T) {
+		store, _ := NewFileTokenStore(t.TempDir())
+		assert.NoError(t, store.Save("default", Token{AccessToken: "miao"}))
+		assert.NoError(t, store.Reject("default", "miao"))
+		_, ok, err := store.Load("default")
+		assert.False(t, ok)
+		assert.NoError(t, err)
+		assert.NoError(t, store.Save("default", Token{AccessToken: "woof"}))
+		_, ok, _ = store.Load("default")
+		assert.True(t, ok)
+	})
+
+	t.Run("should give the lease to one store at a time", func(t *testing.T) {
+		dir := t.TempDir()
+		first, _ := NewFileTokenStore(dir)
+		second, _ := NewFileTokenStore(dir)
+		lead, _ := first.TryLead("default", "first", time.Second)
+		assert.True(t, lead)
+		lead, _ = first.TryLead("default", "first", time.Second)
+		assert.True(t, lead)
+		lead, _ = second.TryLead("default", "second", time.Second)
+		assert.False(t, lead)
+		lead, _ = second.TryLead("other", "second", time.Second)
+		assert.True(t, lead)
+		assert.NoError(t, first.Release("default", "first"))
+		lead, _ = second.TryLead("default", "second", time.Second)
+		assert.True(t, lead)
+	})
+}
+
+func TestRedisTokenStore(t *testing.T) {
+	newStore := func(t *testing.T) (*RedisTokenStore, *miniredis.Miniredis) {
+		mr := miniredis.RunT(t)
+		client, err := NewRedisClient("redis://" + mr.Addr())
+		assert.NoError(t, err)
+		return NewRedisTokenStore(client, "etnograbber:token:"), mr
+	}
+
+	t.Run("should keep the token with its expiry", func(t *testing.T) {
+		store, mr := newStore(t)
+		_, ok, err := store.Load("default")
+		assert.False(t, ok)
+		assert.NoError(t, err)
+		token := Token{AccessToken: "miao", ExpiresAt: newMockClock().Now()}
+		assert.NoError(t, store.Save("default", token))
+		assert.True(t, mr.Exists("etnograbber:token:default"))
+		got, _, _ := store.Load("default")
+		assert.Equal(t, token.AccessToken, got.AccessToken)
+		assert.True(t, token.ExpiresAt.Equal(got.ExpiresAt))
+	})
+
+	t.Run("should not load a rejected token", func(t *testing.T) {
+		store, _ := newStore(t)
+		assert.NoError(t, store.Save("default", Token{AccessToken: "miao"}))
+		assert.NoError(t, store.Reject("default", "miao"))
+		_, ok, err := store.Load("default")
+		assert.False(t, ok)
+		assert.NoError(t, err)
+		assert.NoError(t, store.Save("default", Token{AccessToken: "woof"}))
+		_, ok, _ = store.Load("default")
+		assert.True(t, ok)
+	})
+
+	t.Run("should give the lease to one holder until it expires", func(t *testing.T) {
+		store, mr := newStore(t)
+		lead, err := store.TryLead("default", "first", time.Second*30)
+		assert.NoError(t, err)
+		assert.True(t, lead)
+		lead, _ = store.TryLead("default", "second", time.Second*30)
+		assert.False(t, lead)
+		mr.FastForward(time.Second * 20)
+		lead, _ = store.TryLead("default", "first", time.Second*30)
+		assert.True(t, lead)
+		mr.FastForward(time.Second * 20)
+		lead, _ = store.TryLead("default", "second", time.Second*30)
+		assert.False(t, lead)
+		mr.FastForward(time.Second * 11)
+		lead, _ = store.TryLead("default", "second", time.Second*30)
+		assert.True(t, lead)
+	})
+
+	t.Run("should release only its own lease", func(t *testing.T) {
+		store, _ := newStore(t)
+		store.TryLead("default", "first", time.Second*30)
+		assert.NoError(t, store.Release("default", "second"))
+		lead, _ := store.TryLead("default", "second", time.Second*30)
+		assert.False(t, lead)
+		assert.NoError(t, store.Release("default", "first"))
+		lead, _ = store.TryLead("default", "second", time.Second*30)
+		assert.True(t, lead)
+	})
+
+	t.Run("should fail when redis is down", func(t *testing.T) {
+		store, mr := newStore(t)
+		assert.NoError(t, store.Ping())
+		mr.Close()
+		assert.Error(t, store.Ping())
+		_, err := store.TryLead("default", "first", time.Second)
+		assert.Error(t, err)
+	})
+}
@@ -74,6 +74,26 @@ func TestNewTokenFromJsonData(t *testing.T) {
 			wantErr:    true,
 			wantErrMsg: "Key: 'Token.TokenType' Error:Field validation for 'TokenType' failed on the 'eq' tag",
 		},
+		{
+			name:       "should fail without a refresh token",
+			jsonRepr:   []byte(`{"access_token":"miao","expires_in":3599,"scope":"","token_type":"bearer"}`),
+			time:       time.Date(2021, 8, 25, 8, 0, 0, 0, time.UTC),
+			want:       Token{},
+			wantErr:    true,
+			wantErrMsg: "Key: 'Token.RefreshToken' Error:Field validation for 'RefreshToken' failed on the 'required' tag",
+		},
+		{
+			name:     "should parse a fallback token without a refresh token",
+			jsonRepr: []byte(`{"access_token":"miao","expires_in":3599,"scope":"","token_type":"bearer","source":"fallback"}`),
+			time:     time.Date(2021, 8, 25, 8, 30, 0, 0, time.UTC),
+			want: Token{
+				AccessToken: "miao",
+				ExpiresIn:   3599,
+				ExpiresAt:   time.Date(2021, 8, 25, 9, 29, 59, 0, time.UTC),
+				TokenType:   "bearer",
+				Source:      tokenSourceFallback,
+			},
+		},
 		{
 			name:       "should fail if scope is not empty",
 			jsonRepr:   []byte(`{"access_token":"miao","expires_in":3599,"refresh_token":"bau","scope":"z","token_type":"bearer"}`),
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+type Track struct {
+	Data        []byte
+	ContentType string
+}
+
+// TrackKey identifies a cached track: the original stream when Rendition is
+// empty, a transcoding of it otherwise.
+type TrackKey struct {
+	Id        int
+	Rendition string
+}
+
+func (k TrackKey) String() string {
+	if k.Rendition == "" {
+		return strconv.Itoa(k.Id)
+	}
+	return strconv.Itoa(k.Id) + "/" + k.Rendition
+}
+
+func parseTrackKey(s string) (TrackKey, error) {
+	id, rendition, _ := strings.Cut(s, "/")
+	parsed, err := strconv.Atoi(id)
+	return TrackKey{Id: parsed, Rendition: rendition}, err
+}
+
+type streamFormat struct {
+	contentType string
+	hls         bool
+}
+
+// streamFormats maps the transcodings exposed by the /tracks/:id/streams
+// endpoint, keyed as in stream_formats (the response key minus "_url").
+var streamFormats = map[string]streamFormat{
+	"http_mp3_128": {contentType: "audio/mpeg", hls: false},
+	"hls_mp3_128":  {contentType: "audio/mpeg", hls: true},
+	"hls_aac_160":  {contentType: "audio/mp4", hls: true},
+	"hls_opus_64":  {contentType: "audio/ogg", hls: true},
+}
+
+const legacyStreamContentType = "audio/mpeg"
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	"sync"
+)
+
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Bytes     int64  `json:"bytes"`
+	Entries   int    `json:"entries"`
+}
+
+// MemoryTrackCache is the in-process LRU TrackCache. Eviction callbacks run
+// after the cache is unlocked, so they may use it.
+type MemoryTrackCache struct {
+	mu       sync.Mutex
+	lru      *simplelru.LRU[TrackKey, Track]
+	stats    CacheStats
+	onEvict  []func(key TrackKey, value Track)
+	evicted  []evictedTrack
+	removing bool
+	loads    loadGroup[TrackKey, Track]
+}
+
+type evictedTrack struct {
+	key   TrackKey
+	value Track
+}
+
+func NewMemoryTrackCache(size int) (*MemoryTrackCache, error) {
+	m := &MemoryTrackCache{}
+	cache, err := simplelru.NewLRU[TrackKey, Track](size, m.dropped)
+	if err != nil {
+		return nil, err
+	}
+	m.lru = cache
+	return m, nil
+}
+
+func (m *MemoryTrackCache) Add(key TrackKey, value Track) (evicted bool) {
+	m.mu.Lock()
+	if old, ok := m.lru.Peek(key); ok {
+		m.stats.Bytes -= int64(len(old.Data))
+	}
+	m.stats.Bytes += int64(len(value.Data))
+	evicted = m.lru.Add(key, value)
+	m.unlock()
+	return evicted
+}
+
+func (m *MemoryTrackCache) Contains(key TrackKey) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Contains(key)
+}
+
+func (m *MemoryTrackCache) Get(key TrackKey) (Track, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.lru.Get(key)
+	if ok {
+		m.stats.Hits++
+	} else {
+		m.stats.Misses++
+	}
+	return value, ok
+}
+
+// GetOrLoad looks the key up again once leading the load, a caller that
+// missed just as the previous load finished finds the track it cached.
+func (m *MemoryTrackCache) GetOrLoad(key TrackKey, load func() (Track, error)) (Track, error) {
+	if track, ok := m.Get(key); ok {
+		return track, nil
+	}
+	return m.loads.Do(key, func() (Track, error) {
+		if track, ok := m.peek(key); ok {
+			return track, nil
+		}
+		track, err := load()
+		if err == nil {
+			m.Add(key, track)
+		}
+		return track, err
+	})
+}
+
+// peek gets the track without counting a lookup or refreshing its recency.
+func (m *MemoryTrackCache) peek(key TrackKey) (Track, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Peek(key)
+}
+
+func (m *MemoryTrackCache) Remove(key TrackKey) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removing = true
+	defer func() { m.removing = false }()
+	return m.lru.Remove(key)
+}
+
+func (m *MemoryTrackCache) Keys() []TrackKey {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Keys()
+}
+
+func (m *MemoryTrackCache) Stats() CacheStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stats
+	stats.Entries = m.lru.Len()
+	return stats
+}
+
+func (m *MemoryTrackCache) OnEvict(f func(key TrackKey, value Track)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onEvict = append(m.onEvict, f)
+}
+
+func (m *MemoryTrackCache) Resize(size int) {
+	m.mu.Lock()
+	m.lru.Resize(size)
+	m.unlock()
+}
+
+// dropped is called by the lru, holding mu, for every track leaving it.
+func (m *MemoryTrackCache) dropped(key TrackKey, value Track) {
+	m.stats.Bytes -= int64(len(value.Data))
+	if m.removing {
+		return
+	}
+	m.stats.Evictions++
+	if len(m.onEvict) > 0 {
+		m.evicted = append(m.evicted, evictedTrack{key: key, value: value})
+	}
+}
+
+// unlock releases mu and then tells the callbacks about the tracks evicted
+// while it was held.
+func (m *MemoryTrackCache) unlock() {
+	evicted, callbacks := m.evicted, m.onEvict
+	m.evicted = nil
+	m.mu.Unlock()
+	for _, e := range evicted {
+		for _, f := range callbacks {
+			f(e.key, e.value)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryTrackCache(t *testing.T) {
+	track := func(data string) Track {
+		return Track{Data: []byte(data), ContentType: "audio/mpeg"}
+	}
+
+	t.Run("should count hits, misses, entries and bytes", func(t *testing.T) {
+		cache, _ := NewMemoryTrackCache(10)
+		cache.Add(TrackKey{Id: 1}, track("miao"))
+		cache.Add(TrackKey{Id: 2}, track("bau"))
+		cache.Add(TrackKey{Id: 2}, track("bau bau"))
+		cache.Get(TrackKey{Id: 1})
+		cache.Get(TrackKey{Id: 3})
+		assert.Equal(t, CacheStats{Hits: 1, Misses: 1, Bytes: 11, Entries: 2}, cache.Stats())
+	})
+
+	t.Run("should call back with evicted tracks, not removed ones", func(t *testing.T) {
+		cache, _ := NewMemoryTrackCache(2)
+		var evicted []int
+		cache.OnEvict(func(key TrackKey, value Track) {
+			evicted = append(evicted, key.Id)
+			cache.Contains(key)
+		})
+		cache.Add(TrackKey{Id: 1}, track("miao"))
+		cache.Add(TrackKey{Id: 2}, track("bau"))
+		assert.True(t, cache.Remove(TrackKey{Id: 2}))
+		cache.Add(TrackKey{Id: 3}, track("cra"))
+		assert.True(t, cache.Add(TrackKey{Id: 4}, track("muu")))
+		cache.Resize(1)
+		assert.Equal(t, []int{1, 3}, evicted)
+		assert.Equal(t, []TrackKey{{Id: 4}}, cache.Keys())
+		assert.Equal(t, CacheStats{Evictions: 2, Bytes: 3, Entries: 1}, cache.Stats())
+	})
+
+	t.Run("should load a missing track once for concurrent callers", func(t *testing.T) {
+		cache, _ := NewMemoryTrackCache(10)
+		var loads atomic.Int32
+		release := make(chan struct{})
+		load := func() (Track, error) {
+			loads.Add(1)
+			<-release
+			return track("miao"), nil
+		}
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				got, err := cache.GetOrLoad(TrackKey{Id: 1}, load)
+				assert.NoError(t, err)
+				assert.Equal(t, track("miao"), got)
+			}()
+		}
+		// every caller missed, so it either waits on the load or finds its track
+		assert.Eventually(t, func() bool { return cache.Stats().Misses == 10 }, time.Second, time.Millisecond)
+		close(release)
+		wg.Wait()
+		assert.Equal(t, int32(1), loads.Load())
+		got, err := cache.GetOrLoad(TrackKey{Id: 1}, func() (Track, error) { return Track{}, errors.New("not again") })
+		assert.NoError(t, err)
+		assert.Equal(t, track("miao"), got)
+	})
+
+	t.Run("should return the loaded track even if evicted right away", func(t *testing.T) {
+		cache, _ := NewMemoryTrackCache(1)
+		cache.OnEvict(func(key TrackKey, _ Track) { cache.Remove(TrackKey{Id: 2}) })
+		cache.Add(TrackKey{Id: 1}, track("miao"))
+		got, err := cache.GetOrLoad(TrackKey{Id: 2}, func() (Track, error) { return track("bau"), nil })
+		assert.NoError(t, err)
+		assert.Equal(t, track("bau"), got)
+	})
+
+	t.Run("should not cache failed loads", func(t *testing.T) {
+		cache, _ := NewMemoryTrackCache(10)
+		_, err := cache.GetOrLoad(TrackKey{Id: 1}, func() (Track, error) { return Track{}, errors.New("upstream down") })
+		assert.EqualError(t, err, "upstream down")
+		assert.False(t, cache.Contains(TrackKey{Id: 1}))
+	})
+}
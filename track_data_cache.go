@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/giorgiovilardo/etnograbber/clock"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"time"
+)
+
+// MemoryTrackDataCache keeps track metadata in process for ttl, metadata
+// changing upstream unlike the audio.
+type MemoryTrackDataCache struct {
+	lru   *lru.Cache[int, cachedTrackData]
+	ttl   time.Duration
+	clock clock.Clock
+}
+
+type cachedTrackData struct {
+	value     map[string]interface{}
+	expiresAt time.Time
+}
+
+func NewMemoryTrackDataCache(size int, ttl time.Duration, clock clock.Clock) (*MemoryTrackDataCache, error) {
+	cache, err := lru.New[int, cachedTrackData](size)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryTrackDataCache{lru: cache, ttl: ttl, clock: clock}, nil
+}
+
+func (m *MemoryTrackDataCache) Add(key int, value map[string]interface{}) {
+	m.lru.Add(key, cachedTrackData{value: value, expiresAt: m.clock.Now().Add(m.ttl)})
+}
+
+func (m *MemoryTrackDataCache) Get(key int) (map[string]interface{}, bool) {
+	cached, ok := m.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if !cached.expiresAt.After(m.clock.Now()) {
+		m.lru.Remove(key)
+		return nil, false
+	}
+	return cached.value, true
+}
+
+func (m *MemoryTrackDataCache) Resize(size int) {
+	m.lru.Resize(size)
+}
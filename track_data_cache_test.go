@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newMemoryTrackDataCacheForTest() *MemoryTrackDataCache {
+	cache, _ := NewMemoryTrackDataCache(10, time.Minute*10, newMockClock())
+	return cache
+}
+
+func TestMemoryTrackDataCache(t *testing.T) {
+	t.Run("should keep track data until the ttl expires", func(t *testing.T) {
+		clock := newMockClock()
+		cache, _ := NewMemoryTrackDataCache(10, time.Minute*10, clock)
+		cache.Add(1, map[string]interface{}{"id": 1})
+		got, ok := cache.Get(1)
+		assert.True(t, ok)
+		assert.Equal(t, 1, got["id"])
+		clock.Sleep(time.Minute * 10)
+		_, ok = cache.Get(1)
+		assert.False(t, ok)
+	})
+}
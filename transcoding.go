@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TranscodingConfig struct {
+	FfmpegPath     string        `mapstructure:"ffmpeg_path"`
+	MaxConcurrent  int           `mapstructure:"max_concurrent" validate:"gte=1"`
+	Timeout        time.Duration `mapstructure:"timeout" validate:"gt=0"`
+	MinBitrate     int           `mapstructure:"min_bitrate" validate:"gte=8"`
+	MaxBitrate     int           `mapstructure:"max_bitrate" validate:"gtefield=MinBitrate"`
+	DefaultBitrate int           `mapstructure:"default_bitrate" validate:"gtefield=MinBitrate,ltefield=MaxBitrate"`
+}
+
+// Rendition is a transcoding of a track, Bitrate in kbps.
+type Rendition struct {
+	Format  string
+	Bitrate int
+}
+
+func (r Rendition) String() string {
+	return fmt.Sprintf("%s_%d", r.Format, r.Bitrate)
+}
+
+type transcodingFormat struct {
+	codec       string
+	muxer       string
+	contentType string
+}
+
+var transcodingFormats = map[string]transcodingFormat{
+	"mp3":  {codec: "libmp3lame", muxer: "mp3", contentType: "audio/mpeg"},
+	"opus": {codec: "libopus", muxer: "ogg", contentType: "audio/ogg"},
+	"aac":  {codec: "aac", muxer: "adts", contentType: "audio/aac"},
+}
+
+const defaultTranscodingFormat = "mp3"
+
+// transcodingBitrates are the only bitrates renditions are made at, so a
+// track has a handful of them in the cache at most.
+var transcodingBitrates = []int{32, 48, 64, 96, 128, 160, 192, 256, 320}
+
+var errTranscoderBusy = errors.New("transcoder busy")
+
+// FfmpegTranscoder pipes tracks through a local ffmpeg binary, running at
+// most MaxConcurrent of them. Waiting for a free slot counts towards the
+// timeout.
+type FfmpegTranscoder struct {
+	path    string
+	timeout time.Duration
+	slots   chan struct{}
+}
+
+func NewFfmpegTranscoder(c TranscodingConfig) *FfmpegTranscoder {
+	return &FfmpegTranscoder{path: c.FfmpegPath, timeout: c.Timeout, slots: make(chan struct{}, c.MaxConcurrent)}
+}
+
+func (f *FfmpegTranscoder) Transcode(in Track, r Rendition) (Track, error) {
+	format, ok := transcodingFormats[r.Format]
+	if !ok {
+		return Track{}, fmt.Errorf("unknown format %s", r.Format)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	select {
+	case f.slots <- struct{}{}:
+		defer func() { <-f.slots }()
+	case <-ctx.Done():
+		return Track{}, errTranscoderBusy
+	}
+
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, f.path, ffmpegArgs(format, r.Bitrate)...)
+	cmd.Stdin = bytes.NewReader(in.Data)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Track{}, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	track := Track{Data: out.Bytes(), ContentType: format.contentType}
+	if err := checkTrackContent(track, 1); err != nil {
+		return Track{}, fmt.Errorf("ffmpeg output: %w", err)
+	}
+	return track, nil
+}
+
+func ffmpegArgs(f transcodingFormat, bitrate int) []string {
+	return []string{
+		"-hide_banner", "-loglevel", "error",
+		"-i", "pipe:0", "-vn",
+		"-c:a", f.codec, "-b:a", fmt.Sprintf("%dk", bitrate),
+		"-f", f.muxer, "pipe:1",
+	}
+}
+
+const renditionNotSupported = "bitrate or format not supported"
+
+// parseRendition reads the bitrate and format query params, either can be
+// left out for the configured default bitrate or mp3. The bitrate is rounded
+// to the nearest of transcodingBitrates within the configured bounds.
+func parseRendition(bitrate, format string, c TranscodingConfig) (Rendition, error) {
+	r := Rendition{Format: format, Bitrate: c.DefaultBitrate}
+	if r.Format == "" {
+		r.Format = defaultTranscodingFormat
+	}
+	if _, ok := transcodingFormats[r.Format]; !ok {
+		return Rendition{}, errors.New(renditionNotSupported)
+	}
+	if bitrate != "" {
+		parsed, err := strconv.Atoi(bitrate)
+		if err != nil || parsed < c.MinBitrate || parsed > c.MaxBitrate {
+			return Rendition{}, errors.New(renditionNotSupported)
+		}
+		r.Bitrate = nearestBitrate(parsed, c)
+	}
+	return r, nil
+}
+
+// nearestBitrate picks the closest of transcodingBitrates within bounds,
+// the lower one on a tie, falling back to the default bitrate when the
+// bounds leave none of them.
+func nearestBitrate(bitrate int, c TranscodingConfig) int {
+	nearest, distance := c.DefaultBitrate, -1
+	for _, b := range transcodingBitrates {
+		if b < c.MinBitrate || b > c.MaxBitrate {
+			continue
+		}
+		d := b - bitrate
+		if d < 0 {
+			d = -d
+		}
+		if distance < 0 || d < distance {
+			nearest, distance = b, d
+		}
+	}
+	return nearest
+}
+
+// TranscodeHandler serves the rendition asked with the bitrate and format
+// query params, leaving requests without them to original.
+func TranscodeHandler(s TranscodedTrackService, tc TranscodingConfig, original echo.HandlerFunc) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		bitrate, format := c.QueryParam("bitrate"), c.QueryParam("format")
+		if bitrate == "" && format == "" {
+			return original(c)
+		}
+
+		trackId, err := strconv.Atoi(c.Param("trackId"))
+		if err != nil {
+			return apiError(c, trackIdNotANumber)
+		}
+		rendition, err := parseRendition(bitrate, format, tc)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+
+		track, err := s.GetRendition(trackId, rendition)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.Stream(http.StatusOK, track.ContentType, bytes.NewReader(track.Data))
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+var testTranscodingConfig = TranscodingConfig{MaxConcurrent: 1, Timeout: time.Second * 5, MinBitrate: 32, MaxBitrate: 320, DefaultBitrate: 64}
+
+func TestParseRendition(t *testing.T) {
+	t.Run("should default to mp3 and the default bitrate", func(t *testing.T) {
+		got, err := parseRendition("", "", testTranscodingConfig)
+		assert.NoError(t, err)
+		assert.Equal(t, Rendition{Format: "mp3", Bitrate: 64}, got)
+		got, _ = parseRendition("96", "opus", testTranscodingConfig)
+		assert.Equal(t, "opus_96", got.String())
+	})
+
+	t.Run("should round the bitrate to the nearest supported one", func(t *testing.T) {
+		for bitrate, want := range map[string]int{"33": 32, "80": 64, "100": 96, "300": 320} {
+			got, err := parseRendition(bitrate, "mp3", testTranscodingConfig)
+			assert.NoError(t, err)
+			assert.Equal(t, want, got.Bitrate, bitrate)
+		}
+		c := testTranscodingConfig
+		c.MaxBitrate = 128
+		got, _ := parseRendition("127", "mp3", c)
+		assert.Equal(t, 128, got.Bitrate)
+		c.MinBitrate, c.MaxBitrate, c.DefaultBitrate = 100, 120, 110
+		got, _ = parseRendition("105", "mp3", c)
+		assert.Equal(t, 110, got.Bitrate)
+	})
+
+	t.Run("should reject unknown formats and bitrates out of bounds", func(t *testing.T) {
+		for _, params := range [][2]string{{"64", "flac"}, {"16", "opus"}, {"640", "mp3"}, {"fast", "mp3"}} {
+			_, err := parseRendition(params[0], params[1], testTranscodingConfig)
+			assert.EqualError(t, err, renditionNotSupported)
+		}
+	})
+}
+
+func TestFfmpegTranscoder_Transcode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script standing in for ffmpeg")
+	}
+	fakeFfmpeg := func(t *testing.T, script string) TranscodingConfig {
+		path := filepath.Join(t.TempDir(), "ffmpeg")
+		assert.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700))
+		c := testTranscodingConfig
+		c.FfmpegPath = path
+		return c
+	}
+
+	t.Run("should pipe the track through ffmpeg", func(t *testing.T) {
+		transcoder := NewFfmpegTranscoder(fakeFfmpeg(t, `echo "OggS $@"; cat`))
+		got, err := transcoder.Transcode(Track{Data: []byte("ID3"), ContentType: "audio/mpeg"}, Rendition{Format: "opus", Bitrate: 64})
+		assert.NoError(t, err)
+		assert.Equal(t, "audio/ogg", got.ContentType)
+		assert.Equal(t, "OggS -hide_banner -loglevel error -i pipe:0 -vn -c:a libopus -b:a 64k -f ogg pipe:1\nID3", string(got.Data))
+	})
+
+	t.Run("should reject empty or foreign output", func(t *testing.T) {
+		transcoder := NewFfmpegTranscoder(fakeFfmpeg(t, `exit 0`))
+		_, err := transcoder.Transcode(Track{Data: []byte("ID3")}, Rendition{Format: "mp3", Bitrate: 64})
+		assert.EqualError(t, err, "ffmpeg output: 0 bytes, less than 1")
+		transcoder = NewFfmpegTranscoder(fakeFfmpeg(t, `echo "<html>"`))
+		_, err = transcoder.Transcode(Track{Data: []byte("ID3")}, Rendition{Format: "aac", Bitrate: 64})
+		assert.EqualError(t, err, "ffmpeg output: content is not audio/aac")
+	})
+
+	t.Run("should report what ffmpeg complains about", func(t *testing.T) {
+		transcoder := NewFfmpegTranscoder(fakeFfmpeg(t, `echo "invalid data" >&2; exit 1`))
+		_, err := transcoder.Transcode(Track{Data: []byte("<html>")}, Rendition{Format: "mp3", Bitrate: 64})
+		assert.ErrorContains(t, err, "invalid data")
+	})
+
+	t.Run("should give up when no slot frees up in time", func(t *testing.T) {
+		c := fakeFfmpeg(t, `cat`)
+		c.Timeout = time.Millisecond * 50
+		transcoder := NewFfmpegTranscoder(c)
+		transcoder.slots <- struct{}{}
+		_, err := transcoder.Transcode(Track{}, Rendition{Format: "mp3", Bitrate: 64})
+		assert.ErrorIs(t, err, errTranscoderBusy)
+	})
+}
+
+func TestTranscodeHandler(t *testing.T) {
+	setupEcho := func(target string) (echo.Context, *httptest.ResponseRecorder) {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/:trackId/stream")
+		c.SetParamNames("trackId")
+		c.SetParamValues("1234")
+		return c, rec
+	}
+	handler := TranscodeHandler(mockTranscodedTrackService{}, testTranscodingConfig, TrackHandler(mockTrackService{}))
+
+	t.Run("should serve the original without bitrate and format", func(t *testing.T) {
+		c, r := setupEcho("/1234/stream")
+		if assert.NoError(t, handler(c)) {
+			assert.Equal(t, "audio/mpeg", r.Header().Get("Content-Type"))
+			assert.Equal(t, "yolo", r.Body.String())
+		}
+	})
+
+	t.Run("should serve the rendition asked", func(t *testing.T) {
+		c, r := setupEcho("/1234/stream?bitrate=64&format=opus")
+		if assert.NoError(t, handler(c)) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.Equal(t, "audio/ogg", r.Header().Get("Content-Type"))
+			assert.Equal(t, "1234/opus_64", r.Body.String())
+		}
+	})
+
+	t.Run("should answer 400 to unsupported renditions", func(t *testing.T) {
+		c, r := setupEcho("/1234/stream?format=flac")
+		if assert.NoError(t, handler(c)) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+			assert.JSONEq(t, `{"error":"bitrate or format not supported"}`, r.Body.String())
+		}
+	})
+
+	t.Run("should answer 503 when transcoding fails", func(t *testing.T) {
+		c, r := setupEcho("/1234/stream?bitrate=64")
+		failing := TranscodeHandler(mockTranscodedTrackService{err: newServiceError("transcoding not available", errTranscoderBusy)}, testTranscodingConfig, nil)
+		if assert.NoError(t, failing(c)) {
+			assert.Equal(t, http.StatusServiceUnavailable, r.Code)
+			assert.JSONEq(t, `{"error":"transcoding not available"}`, r.Body.String())
+		}
+	})
+}
+
+func TestHttpTranscodedTrackService_GetRendition(t *testing.T) {
+	t.Run("should cache each rendition apart from the original", func(t *testing.T) {
+		cache, _ := NewMemoryTrackCache(10)
+		transcoder := &mockTranscoder{}
+		tracks := NewHttpCachedTrackService(cache, mockTokenRepository{}, mockTrackRepository{}, mockTrackValidator{})
+		service := NewHttpTranscodedTrackService(cache, tracks, transcoder)
+		got, err := service.GetRendition(1, Rendition{Format: "opus", Bitrate: 64})
+		assert.NoError(t, err)
+		assert.Equal(t, Track{Data: []byte("bau1 as opus_64"), ContentType: "audio/ogg"}, got)
+		_, _ = service.GetRendition(1, Rendition{Format: "opus", Bitrate: 64})
+		_, _ = service.GetRendition(1, Rendition{Format: "mp3", Bitrate: 64})
+		assert.Equal(t, 2, transcoder.calls)
+		assert.ElementsMatch(t, []TrackKey{{Id: 1}, {Id: 1, Rendition: "opus_64"}, {Id: 1, Rendition: "mp3_64"}}, cache.Keys())
+	})
+
+	t.Run("should not cache failed transcodings", func(t *testing.T) {
+		cache, _ := NewMemoryTrackCache(10)
+		tracks := NewHttpCachedTrackService(cache, mockTokenRepository{}, mockTrackRepository{}, mockTrackValidator{})
+		service := NewHttpTranscodedTrackService(cache, tracks, &mockTranscoder{err: errors.New("ffmpeg: exit status 1")})
+		_, err := service.GetRendition(1, Rendition{Format: "opus", Bitrate: 64})
+		assert.EqualError(t, err, "transcoding not available")
+		assert.False(t, cache.Contains(TrackKey{Id: 1, Rendition: "opus_64"}))
+	})
+}
+
+type mockTranscoder struct {
+	err   error
+	calls int
+}
+
+func (m *mockTranscoder) Transcode(in Track, r Rendition) (Track, error) {
+	m.calls++
+	if m.err != nil {
+		return Track{}, m.err
+	}
+	return Track{Data: []byte(string(in.Data) + " as " + r.String()), ContentType: transcodingFormats[r.Format].contentType}, nil
+}
+
+type mockTranscodedTrackService struct {
+	err error
+}
+
+func (m mockTranscodedTrackService) GetRendition(id int, r Rendition) (Track, error) {
+	if m.err != nil {
+		return Track{}, m.err
+	}
+	return Track{Data: []byte(TrackKey{Id: id, Rendition: r.String()}.String()), ContentType: transcodingFormats[r.Format].contentType}, nil
+}
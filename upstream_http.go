@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type UpstreamHttpConfig struct {
+	AuthTimeout          time.Duration `mapstructure:"auth_timeout" validate:"gte=0"`
+	MetadataTimeout      time.Duration `mapstructure:"metadata_timeout" validate:"gte=0"`
+	StreamConnectTimeout time.Duration `mapstructure:"stream_connect_timeout" validate:"gte=0"`
+	StreamIdleTimeout    time.Duration `mapstructure:"stream_idle_timeout" validate:"gte=0"`
+	MaxIdleConns         int           `mapstructure:"max_idle_conns" validate:"gte=0"`
+	MaxIdleConnsPerHost  int           `mapstructure:"max_idle_conns_per_host" validate:"gte=0"`
+	IdleConnTimeout      time.Duration `mapstructure:"idle_conn_timeout" validate:"gte=0"`
+	TlsHandshakeTimeout  time.Duration `mapstructure:"tls_handshake_timeout" validate:"gte=0"`
+	Proxy                string        `mapstructure:"proxy" validate:"omitempty,url"`
+}
+
+// NewUpstreamTransport builds the transport shared by every call to
+// SoundCloud, so connections are kept alive and reused. Without a proxy
+// the usual HTTP_PROXY/HTTPS_PROXY variables are honoured.
+func NewUpstreamTransport(c UpstreamHttpConfig) *http.Transport {
+	dialer := &net.Dialer{Timeout: time.Second * 30, KeepAlive: time.Second * 30}
+	t := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        c.MaxIdleConns,
+		MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+		IdleConnTimeout:     c.IdleConnTimeout,
+		TLSHandshakeTimeout: c.TlsHandshakeTimeout,
+	}
+	if proxyUrl, err := url.Parse(c.Proxy); c.Proxy != "" && err == nil {
+		t.Proxy = http.ProxyURL(proxyUrl)
+	}
+	return t
+}
+
+// requestTimeouts bound a single upstream exchange. total covers everything
+// up to closing the body, header the wait for the response headers and idle
+// the longest pause between two reads of the body. Zero means no limit.
+type requestTimeouts struct {
+	total  time.Duration
+	header time.Duration
+	idle   time.Duration
+}
+
+// doWithTimeouts sends req on client, cancelling it as soon as one of the
+// timeouts expires. The returned body releases the request when closed.
+func doWithTimeouts(client *http.Client, req *http.Request, t requestTimeouts) (*http.Response, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if t.total > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), t.total)
+	} else {
+		ctx, cancel = context.WithCancel(req.Context())
+	}
+
+	var headerTimer *time.Timer
+	if t.header > 0 {
+		headerTimer = time.AfterFunc(t.header, cancel)
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if headerTimer != nil {
+		headerTimer.Stop()
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	body := &timeoutBody{ReadCloser: res.Body, cancel: cancel, idle: t.idle}
+	if t.idle > 0 {
+		body.timer = time.AfterFunc(t.idle, cancel)
+	}
+	res.Body = body
+	return res, nil
+}
+
+// timeoutBody cancels its request when reads stall for longer than idle.
+type timeoutBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	idle   time.Duration
+	timer  *time.Timer
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.timer != nil && err == nil {
+		b.timer.Reset(b.idle)
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNewUpstreamTransport(t *testing.T) {
+	t.Run("should route through the configured proxy", func(t *testing.T) {
+		transport := NewUpstreamTransport(UpstreamHttpConfig{Proxy: "http://proxy.local:3128", MaxIdleConnsPerHost: 10})
+		req, _ := http.NewRequest(http.MethodGet, "https://api.soundcloud.com/tracks/1", nil)
+		proxy, err := transport.Proxy(req)
+		assert.NoError(t, err)
+		assert.Equal(t, &url.URL{Scheme: "http", Host: "proxy.local:3128"}, proxy)
+		assert.Equal(t, 10, transport.MaxIdleConnsPerHost)
+	})
+}
+
+func TestDoWithTimeouts(t *testing.T) {
+	slowHeaders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slowHeaders.Close()
+	stallingBody := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("micio"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer stallingBody.Close()
+	client := &http.Client{}
+
+	t.Run("should give up waiting for the headers", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, slowHeaders.URL, nil)
+		_, err := doWithTimeouts(client, req, requestTimeouts{header: time.Millisecond * 20})
+		assert.Error(t, err)
+	})
+
+	t.Run("should give up on a stalled body", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, stallingBody.URL, nil)
+		res, err := doWithTimeouts(client, req, requestTimeouts{header: time.Second, idle: time.Millisecond * 20})
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		assert.Error(t, err)
+		assert.Equal(t, "micio", string(body))
+	})
+
+	t.Run("should bound the whole exchange", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, stallingBody.URL, nil)
+		res, err := doWithTimeouts(client, req, requestTimeouts{total: time.Millisecond * 50})
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		_, err = io.ReadAll(res.Body)
+		assert.Error(t, err)
+	})
+
+	t.Run("should not limit without timeouts", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("micio"))
+		}))
+		defer server.Close()
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		res, err := doWithTimeouts(client, req, requestTimeouts{})
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		assert.NoError(t, res.Body.Close())
+		assert.Equal(t, "micio", string(body))
+	})
+}
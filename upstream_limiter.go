@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/giorgiovilardo/etnograbber/clock"
+	"golang.org/x/time/rate"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type UpstreamRateLimitConfig struct {
+	RequestsPerSecond float64       `mapstructure:"requests_per_second" validate:"gte=0"`
+	Burst             int           `mapstructure:"burst" validate:"gte=0"`
+	MaxWait           time.Duration `mapstructure:"max_wait" validate:"gte=0"`
+	DefaultPause      time.Duration `mapstructure:"default_pause" validate:"gte=0"`
+}
+
+type RateLimitedError struct {
+	wait time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return "rate limited by upstream"
+}
+
+func (e *RateLimitedError) RetryAfter() time.Duration {
+	return e.wait
+}
+
+// UpstreamLimiter is a token bucket shared by every call to SoundCloud.
+// When SoundCloud answers 429 all outbound traffic is paused until the time
+// it asked for, failing fast in the meantime.
+// A zero RequestsPerSecond lets everything through, but 429s still pause.
+type UpstreamLimiter struct {
+	c           UpstreamRateLimitConfig
+	clock       clock.Clock
+	limiter     *rate.Limiter
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+func NewUpstreamLimiter(c UpstreamRateLimitConfig, clock clock.Clock) *UpstreamLimiter {
+	return &UpstreamLimiter{c: c, clock: clock, limiter: rate.NewLimiter(upstreamLimit(c))}
+}
+
+func (l *UpstreamLimiter) Reload(c UpstreamRateLimitConfig) {
+	limit, burst := upstreamLimit(c)
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.c = c
+	l.limiter.SetLimitAt(now, limit)
+	l.limiter.SetBurstAt(now, burst)
+}
+
+// Wait blocks until a call may be made, or fails if that would take longer
+// than MaxWait or traffic is paused.
+func (l *UpstreamLimiter) Wait() error {
+	now := l.clock.Now()
+	if wait := l.PausedFor(); wait > 0 {
+		return &RateLimitedError{wait: wait}
+	}
+
+	l.mu.Lock()
+	maxWait := l.c.MaxWait
+	l.mu.Unlock()
+	reservation := l.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if maxWait > 0 && delay > maxWait {
+		reservation.CancelAt(now)
+		return &RateLimitedError{wait: delay}
+	}
+	if delay > 0 {
+		l.clock.Sleep(delay)
+	}
+	return nil
+}
+
+// Observe pauses outbound traffic if the response says we are rate limited.
+func (l *UpstreamLimiter) Observe(res *http.Response) {
+	now := l.clock.Now()
+	wait, limited := rateLimitWait(res, now)
+	if !limited {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if wait == 0 {
+		wait = l.c.DefaultPause
+	}
+	if until := now.Add(wait); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+func (l *UpstreamLimiter) PausedFor() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pausedUntil.Sub(l.clock.Now())
+}
+
+func upstreamLimit(c UpstreamRateLimitConfig) (rate.Limit, int) {
+	limit := rate.Inf
+	if c.RequestsPerSecond > 0 {
+		limit = rate.Limit(c.RequestsPerSecond)
+	}
+	if c.Burst < 1 {
+		return limit, 1
+	}
+	return limit, c.Burst
+}
+
+// rateLimitWait reports whether the response is a rate limit, either a 429
+// or an exhausted X-RateLimit-Remaining, and how long upstream asked to wait,
+// from Retry-After or X-RateLimit-Reset (epoch seconds or seconds from now).
+func rateLimitWait(res *http.Response, now time.Time) (time.Duration, bool) {
+	exhausted := res.Header.Get("X-RateLimit-Remaining") == "0"
+	if res.StatusCode != http.StatusTooManyRequests && !exhausted {
+		return 0, false
+	}
+	if wait, ok := retryAfter(res, now); ok {
+		return wait, true
+	}
+	if reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		if reset > now.Unix()/2 {
+			return time.Unix(reset, 0).Sub(now), true
+		}
+		return time.Duration(reset) * time.Second, true
+	}
+	return 0, true
+}
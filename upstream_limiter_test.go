@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUpstreamLimiter_Wait(t *testing.T) {
+	t.Run("should let the burst through and then space calls out", func(t *testing.T) {
+		clock := newMockClock()
+		l := NewUpstreamLimiter(UpstreamRateLimitConfig{RequestsPerSecond: 2, Burst: 2}, clock)
+		assert.NoError(t, l.Wait())
+		assert.NoError(t, l.Wait())
+		assert.Empty(t, clock.slept)
+		assert.NoError(t, l.Wait())
+		assert.Equal(t, []time.Duration{time.Millisecond * 500}, clock.slept)
+	})
+
+	t.Run("should fail instead of waiting longer than max wait", func(t *testing.T) {
+		clock := newMockClock()
+		l := NewUpstreamLimiter(UpstreamRateLimitConfig{RequestsPerSecond: 1, Burst: 1, MaxWait: time.Millisecond * 100}, clock)
+		assert.NoError(t, l.Wait())
+		var limited *RateLimitedError
+		assert.True(t, errors.As(l.Wait(), &limited))
+		assert.Equal(t, time.Second, limited.RetryAfter())
+		assert.Empty(t, clock.slept)
+	})
+
+	t.Run("should apply new limits on reload", func(t *testing.T) {
+		clock := newMockClock()
+		l := NewUpstreamLimiter(UpstreamRateLimitConfig{}, clock)
+		l.Reload(UpstreamRateLimitConfig{RequestsPerSecond: 1, Burst: 1, MaxWait: time.Millisecond})
+		assert.NoError(t, l.Wait())
+		assert.Error(t, l.Wait())
+	})
+
+	t.Run("should never wait when unlimited", func(t *testing.T) {
+		clock := newMockClock()
+		l := NewUpstreamLimiter(UpstreamRateLimitConfig{}, clock)
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, l.Wait())
+		}
+		assert.Empty(t, clock.slept)
+	})
+}
+
+func TestUpstreamLimiter_Observe(t *testing.T) {
+	newResponse := func(status int, headers map[string]string) *http.Response {
+		res := &http.Response{StatusCode: status, Header: http.Header{}}
+		for k, v := range headers {
+			res.Header.Set(k, v)
+		}
+		return res
+	}
+
+	t.Run("should pause all traffic for what retry-after asks", func(t *testing.T) {
+		clock := newMockClock()
+		l := NewUpstreamLimiter(UpstreamRateLimitConfig{}, clock)
+		l.Observe(newResponse(http.StatusTooManyRequests, map[string]string{"Retry-After": "120"}))
+		var limited *RateLimitedError
+		assert.True(t, errors.As(l.Wait(), &limited))
+		assert.Equal(t, time.Second*120, limited.RetryAfter())
+		clock.Sleep(time.Second * 120)
+		assert.NoError(t, l.Wait())
+	})
+
+	t.Run("should pause until the rate limit reset", func(t *testing.T) {
+		clock := newMockClock()
+		l := NewUpstreamLimiter(UpstreamRateLimitConfig{}, clock)
+		reset := strconv.FormatInt(clock.Now().Add(time.Minute).Unix(), 10)
+		l.Observe(newResponse(http.StatusOK, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": reset}))
+		assert.Equal(t, time.Minute, l.PausedFor())
+	})
+
+	t.Run("should accept a reset expressed in seconds", func(t *testing.T) {
+		clock := newMockClock()
+		l := NewUpstreamLimiter(UpstreamRateLimitConfig{}, clock)
+		l.Observe(newResponse(http.StatusTooManyRequests, map[string]string{"X-RateLimit-Reset": "30"}))
+		assert.Equal(t, time.Second*30, l.PausedFor())
+	})
+
+	t.Run("should use the default pause if upstream does not say", func(t *testing.T) {
+		clock := newMockClock()
+		l := NewUpstreamLimiter(UpstreamRateLimitConfig{DefaultPause: time.Minute}, clock)
+		l.Observe(newResponse(http.StatusTooManyRequests, nil))
+		assert.Equal(t, time.Minute, l.PausedFor())
+	})
+
+	t.Run("should ignore responses that are not rate limits", func(t *testing.T) {
+		clock := newMockClock()
+		l := NewUpstreamLimiter(UpstreamRateLimitConfig{DefaultPause: time.Minute}, clock)
+		l.Observe(newResponse(http.StatusServiceUnavailable, map[string]string{"Retry-After": "120", "X-RateLimit-Remaining": "3"}))
+		assert.NoError(t, l.Wait())
+	})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	waveformSourceSoundcloud = "soundcloud"
+	waveformSourcePeaks      = "peaks"
+)
+
+type WaveformConfig struct {
+	Source     string `mapstructure:"source" validate:"oneof=soundcloud peaks"`
+	Samples    int    `mapstructure:"samples" validate:"gte=1,ltefield=MaxSamples"`
+	MaxSamples int    `mapstructure:"max_samples" validate:"gte=1"`
+	CacheSize  int    `mapstructure:"cache_size" validate:"gte=1"`
+}
+
+// Waveform has the shape of the SoundCloud waveform json: samples between 0
+// and height, width of them.
+type Waveform struct {
+	Width   int   `json:"width"`
+	Height  int   `json:"height"`
+	Samples []int `json:"samples"`
+}
+
+// Resample returns the waveform with n samples, each the peak of the ones
+// it replaces.
+func (w Waveform) Resample(n int) Waveform {
+	if len(w.Samples) == 0 || n == len(w.Samples) {
+		return w
+	}
+	samples := make([]int, n)
+	for i := range samples {
+		from := i * len(w.Samples) / n
+		to := (i + 1) * len(w.Samples) / n
+		if to <= from {
+			to = from + 1
+		}
+		for _, sample := range w.Samples[from:to] {
+			if sample > samples[i] {
+				samples[i] = sample
+			}
+		}
+	}
+	return Waveform{Width: n, Height: w.Height, Samples: samples}
+}
+
+// waveformJsonUrl points the png waveform_url of the track metadata to its
+// json twin.
+func waveformJsonUrl(trackData map[string]interface{}) (string, error) {
+	waveformUrl, _ := trackData["waveform_url"].(string)
+	if waveformUrl == "" {
+		return "", errors.New("track has no waveform_url")
+	}
+	return strings.TrimSuffix(waveformUrl, ".png") + ".json", nil
+}
+
+// waveformHeight is the height of SoundCloud waveforms, used for the peaks
+// computed here too.
+const waveformHeight = 140
+
+// mp3Peaks draws a waveform from the global gain of every mp3 frame, which
+// follows the loudness of the frame closely enough without decoding it.
+func mp3Peaks(data []byte) (Waveform, error) {
+	gains := mp3FrameGains(data)
+	if len(gains) == 0 {
+		return Waveform{}, errors.New("no mp3 frames found")
+	}
+
+	lowest, highest := gains[0], gains[0]
+	for _, gain := range gains {
+		if gain < lowest {
+			lowest = gain
+		}
+		if gain > highest {
+			highest = gain
+		}
+	}
+	samples := make([]int, len(gains))
+	for i, gain := range gains {
+		if highest > lowest {
+			samples[i] = (gain - lowest) * waveformHeight / (highest - lowest)
+		}
+	}
+	return Waveform{Width: len(samples), Height: waveformHeight, Samples: samples}, nil
+}
+
+var (
+	mp3Bitrates     = [2][15]int{{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}, {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}}
+	mp3SampleRates  = [3]int{44100, 48000, 32000}
+	errNotMp3Header = errors.New("not an mpeg layer 3 frame header")
+)
+
+type mp3Frame struct {
+	mpeg1  bool
+	crc    bool
+	mono   bool
+	length int
+}
+
+func parseMp3Frame(h []byte) (mp3Frame, error) {
+	if len(h) < 4 || h[0] != 0xff || h[1]&0xe0 != 0xe0 {
+		return mp3Frame{}, errNotMp3Header
+	}
+	version, layer := h[1]>>3&3, h[1]>>1&3
+	bitrateIndex, sampleRateIndex := h[2]>>4, h[2]>>2&3
+	if version == 1 || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return mp3Frame{}, errNotMp3Header
+	}
+
+	f := mp3Frame{mpeg1: version == 3, crc: h[1]&1 == 0, mono: h[3]>>6 == 3}
+	sampleRate := mp3SampleRates[sampleRateIndex]
+	padding := int(h[2] >> 1 & 1)
+	if f.mpeg1 {
+		f.length = 144*mp3Bitrates[0][bitrateIndex]*1000/sampleRate + padding
+	} else {
+		// mpeg 2 halves the sample rate, 2.5 quarters it
+		sampleRate /= 2
+		if version == 0 {
+			sampleRate /= 2
+		}
+		f.length = 72*mp3Bitrates[1][bitrateIndex]*1000/sampleRate + padding
+	}
+	return f, nil
+}
+
+// mp3FrameGains returns the highest global gain of each frame, skipping an
+// id3v2 tag and any byte that is not part of a frame.
+func mp3FrameGains(data []byte) []int {
+	pos := 0
+	if len(data) >= 10 && string(data[:3]) == "ID3" {
+		pos = 10 + (int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9]))
+		if data[5]&0x10 != 0 {
+			pos += 10
+		}
+	}
+
+	var gains []int
+	for pos+4 <= len(data) {
+		f, err := parseMp3Frame(data[pos:])
+		if err != nil || pos+f.length > len(data) {
+			pos++
+			continue
+		}
+		gains = append(gains, f.globalGain(data[pos:pos+f.length]))
+		pos += f.length
+	}
+	return gains
+}
+
+// globalGain reads the side info following the header, its layout depending
+// on the mpeg version and the number of channels.
+func (f mp3Frame) globalGain(frame []byte) int {
+	r := bitReader{data: frame, pos: 32}
+	if f.crc {
+		r.pos += 16
+	}
+	channels, granules := 2, 1
+	if f.mono {
+		channels = 1
+	}
+	if f.mpeg1 {
+		granules = 2
+		r.pos += 9 + 4*channels
+		if f.mono {
+			r.pos += 5
+		} else {
+			r.pos += 3
+		}
+	} else {
+		r.pos += 8 + channels
+	}
+
+	gain := 0
+	for g := 0; g < granules; g++ {
+		for c := 0; c < channels; c++ {
+			r.pos += 12 + 9
+			if granuleGain := r.read(8); granuleGain > gain {
+				gain = granuleGain
+			}
+			if f.mpeg1 {
+				r.pos += 30
+			} else {
+				r.pos += 34
+			}
+		}
+	}
+	return gain
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) read(n int) int {
+	value := 0
+	for i := 0; i < n; i++ {
+		bit := 0
+		if byteIndex := (r.pos + i) / 8; byteIndex < len(r.data) {
+			bit = int(r.data[byteIndex]>>(7-(r.pos+i)%8)) & 1
+		}
+		value = value<<1 | bit
+	}
+	r.pos += n
+	return value
+}
+
+const samplesNotValid = "samples not valid"
+
+// WaveformHandler answers with the waveform at the samples query param or
+// the configured number of samples.
+func WaveformHandler(s WaveformService, wc WaveformConfig) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		trackId, err := strconv.Atoi(c.Param("trackId"))
+		if err != nil {
+			return apiError(c, trackIdNotANumber)
+		}
+
+		samples := wc.Samples
+		if param := c.QueryParam("samples"); param != "" {
+			samples, err = strconv.Atoi(param)
+			if err != nil || samples < 1 || samples > wc.MaxSamples {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": samplesNotValid})
+			}
+		}
+
+		waveform, err := s.GetWaveform(trackId, samples)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, waveform)
+	}
+}
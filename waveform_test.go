@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// mp3Frames builds mpeg 1 layer 3 mono frames at 128kbps and 44.1kHz, one
+// per gain, both granules carrying it.
+func mp3Frames(gains ...int) []byte {
+	var data []byte
+	for _, gain := range gains {
+		frame := make([]byte, 417)
+		copy(frame, []byte{0xff, 0xfb, 0x90, 0xc0})
+		for _, at := range []int{32 + 18 + 21, 32 + 18 + 59 + 21} {
+			for i := 0; i < 8; i++ {
+				if gain>>(7-i)&1 == 1 {
+					frame[(at+i)/8] |= 0x80 >> ((at + i) % 8)
+				}
+			}
+		}
+		data = append(data, frame...)
+	}
+	return data
+}
+
+func TestWaveform_Resample(t *testing.T) {
+	w := Waveform{Width: 6, Height: 140, Samples: []int{1, 5, 2, 8, 3, 0}}
+
+	t.Run("should keep the peak of the samples merged", func(t *testing.T) {
+		assert.Equal(t, Waveform{Width: 3, Height: 140, Samples: []int{5, 8, 3}}, w.Resample(3))
+	})
+
+	t.Run("should repeat samples when asked for more", func(t *testing.T) {
+		assert.Equal(t, []int{1, 1, 5, 5, 2, 2, 8, 8, 3, 3, 0, 0}, w.Resample(12).Samples)
+	})
+}
+
+func TestMp3Peaks(t *testing.T) {
+	t.Run("should follow the global gain of the frames", func(t *testing.T) {
+		id3 := []byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, 3, 0xff, 0xfb, 0x90}
+		got, err := mp3Peaks(append(id3, mp3Frames(100, 170, 135, 100)...))
+		assert.NoError(t, err)
+		assert.Equal(t, Waveform{Width: 4, Height: 140, Samples: []int{0, 140, 70, 0}}, got)
+	})
+
+	t.Run("should fail on content that is not mp3", func(t *testing.T) {
+		_, err := mp3Peaks([]byte("OggS not an mp3 at all"))
+		assert.EqualError(t, err, "no mp3 frames found")
+	})
+}
+
+func TestHttpWaveformService_GetWaveform(t *testing.T) {
+	newService := func(source string, tds TrackDataService, wr WaveformRepository, ts TrackService) (*HttpWaveformService, *lru.Cache[int, Waveform]) {
+		cache, _ := lru.New[int, Waveform](10)
+		return NewHttpWaveformService(cache, source, mockTokenRepository{}, tds, wr, ts), cache
+	}
+	withWaveformUrl := mockWaveformTrackDataService{"waveform_url": "https://wave.sndcdn.com/abc_m.png"}
+
+	t.Run("should proxy the json waveform of the track", func(t *testing.T) {
+		wr := &mockWaveformRepository{}
+		service, cache := newService(waveformSourceSoundcloud, withWaveformUrl, wr, mockTrackService{})
+		got, err := service.GetWaveform(1, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, "https://wave.sndcdn.com/abc_m.json", wr.url)
+		assert.Equal(t, Waveform{Width: 2, Height: 140, Samples: []int{20, 40}}, got)
+		cached, _ := cache.Get(1)
+		assert.Len(t, cached.Samples, 4)
+	})
+
+	t.Run("should serve cached waveforms at any number of samples", func(t *testing.T) {
+		wr := &mockWaveformRepository{}
+		service, _ := newService(waveformSourceSoundcloud, withWaveformUrl, wr, mockTrackService{})
+		_, _ = service.GetWaveform(1, 2)
+		got, _ := service.GetWaveform(1, 1)
+		assert.Equal(t, []int{40}, got.Samples)
+		assert.Equal(t, 1, wr.calls)
+	})
+
+	t.Run("should fail when the track has no waveform", func(t *testing.T) {
+		service, _ := newService(waveformSourceSoundcloud, mockWaveformTrackDataService{}, &mockWaveformRepository{}, mockTrackService{})
+		_, err := service.GetWaveform(1, 2)
+		assert.EqualError(t, err, "waveform not available")
+	})
+
+	t.Run("should compute peaks from the track", func(t *testing.T) {
+		service, _ := newService(waveformSourcePeaks, nil, nil, mockWaveformTrackService(mp3Frames(100, 170)))
+		got, err := service.GetWaveform(1, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{0, 140}, got.Samples)
+	})
+
+	t.Run("should not compute peaks from a stream that is not mp3", func(t *testing.T) {
+		service, _ := newService(waveformSourcePeaks, nil, nil, mockTrackService{contentType: "audio/mp4"})
+		_, err := service.GetWaveform(1, 2)
+		assert.EqualError(t, err, "waveform not available")
+		assert.ErrorContains(t, errors.Unwrap(err), "peaks need an mp3 stream, got audio/mp4")
+	})
+}
+
+func TestWaveformHandler(t *testing.T) {
+	setupEcho := func(target string) (echo.Context, *httptest.ResponseRecorder) {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/:trackId/waveform")
+		c.SetParamNames("trackId")
+		c.SetParamValues("1234")
+		return c, rec
+	}
+	wc := WaveformConfig{Samples: 2, MaxSamples: 3}
+	service := NewHttpWaveformService(nil, waveformSourcePeaks, nil, nil, nil, mockWaveformTrackService(mp3Frames(100, 170, 100)))
+	service.c, _ = lru.New[int, Waveform](10)
+
+	t.Run("should answer with the configured number of samples", func(t *testing.T) {
+		c, r := setupEcho("/1234/waveform")
+		if assert.NoError(t, WaveformHandler(service, wc)(c)) {
+			assert.Equal(t, http.StatusOK, r.Code)
+			assert.JSONEq(t, `{"width":2,"height":140,"samples":[0,140]}`, r.Body.String())
+		}
+	})
+
+	t.Run("should answer with the samples asked", func(t *testing.T) {
+		c, r := setupEcho("/1234/waveform?samples=3")
+		if assert.NoError(t, WaveformHandler(service, wc)(c)) {
+			assert.JSONEq(t, `{"width":3,"height":140,"samples":[0,140,0]}`, r.Body.String())
+		}
+	})
+
+	t.Run("should answer 400 to samples above the maximum", func(t *testing.T) {
+		c, r := setupEcho("/1234/waveform?samples=4")
+		if assert.NoError(t, WaveformHandler(service, wc)(c)) {
+			assert.Equal(t, http.StatusBadRequest, r.Code)
+			assert.JSONEq(t, `{"error":"samples not valid"}`, r.Body.String())
+		}
+	})
+}
+
+type mockWaveformTrackDataService map[string]interface{}
+
+func (m mockWaveformTrackDataService) GetTrackData(_ int) (map[string]interface{}, error) {
+	return m, nil
+}
+
+type mockWaveformRepository struct {
+	url   string
+	calls int
+}
+
+func (m *mockWaveformRepository) GetWaveform(_ Token, waveformUrl string) (Waveform, error) {
+	m.url = waveformUrl
+	m.calls++
+	return Waveform{Width: 4, Height: 140, Samples: []int{10, 20, 30, 40}}, nil
+}
+
+type mockWaveformTrackService []byte
+
+func (m mockWaveformTrackService) GetTrack(_ int) (Track, error) {
+	return Track{Data: m, ContentType: "audio/mpeg"}, nil
+}